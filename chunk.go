@@ -0,0 +1,114 @@
+package toolkit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+const (
+	chunkWindowSize = 64
+	chunkPrime      = 153191
+	chunkMinSize    = 2 * 1024
+	chunkMaxSize    = 64 * 1024
+	chunkMask       = 8*1024 - 1
+)
+
+type ChunkStore interface {
+	Has(key string) (bool, error)
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+}
+
+func (t *Tools) ChunkAndStore(r io.Reader, store ChunkStore) ([]string, error) {
+	var manifest []string
+
+	// the factor a byte leaving the window was multiplied by: prime^(window-1)
+	var outFactor uint64 = 1
+	for i := 0; i < chunkWindowSize-1; i++ {
+		outFactor *= chunkPrime
+	}
+
+	br := bufio.NewReader(r)
+	chunk := make([]byte, 0, chunkMaxSize)
+
+	var hash uint64
+
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		sum := sha256.Sum256(chunk)
+		key := hex.EncodeToString(sum[:])
+
+		exists, err := store.Has(key)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			if err := store.Put(key, bytes.Clone(chunk)); err != nil {
+				return err
+			}
+		}
+
+		manifest = append(manifest, key)
+		chunk = chunk[:0]
+		hash = 0
+
+		return nil
+	}
+
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		chunk = append(chunk, b)
+
+		if len(chunk) > chunkWindowSize {
+			hash -= uint64(chunk[len(chunk)-chunkWindowSize-1]) * outFactor
+		}
+		hash = hash*chunkPrime + uint64(b)
+
+		if len(chunk) >= chunkMaxSize || (len(chunk) >= chunkMinSize && hash&chunkMask == 0) {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func (t *Tools) Reassemble(manifest []string, w io.Writer, store ChunkStore) error {
+	for _, key := range manifest {
+		data, err := store.Get(key)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != key {
+			return fmt.Errorf("chunk %s is corrupted", key)
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package toolkit
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+type memoryChunkStore struct {
+	chunks map[string][]byte
+}
+
+func (s *memoryChunkStore) Has(key string) (bool, error) {
+	_, ok := s.chunks[key]
+	return ok, nil
+}
+
+func (s *memoryChunkStore) Put(key string, data []byte) error {
+	s.chunks[key] = data
+	return nil
+}
+
+func (s *memoryChunkStore) Get(key string) ([]byte, error) {
+	data, ok := s.chunks[key]
+	if !ok {
+		return nil, errors.New("chunk not found")
+	}
+	return data, nil
+}
+
+func TestTools_ChunkAndStore(t *testing.T) {
+	var tools Tools
+
+	store := &memoryChunkStore{chunks: make(map[string][]byte)}
+
+	data := make([]byte, 512*1024)
+	src := rand.NewChaCha8([32]byte{})
+	src.Read(data)
+
+	manifest, err := tools.ChunkAndStore(bytes.NewReader(data), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest) < 2 {
+		t.Fatalf("expected data to be split into several chunks, got %d", len(manifest))
+	}
+
+	for _, key := range manifest {
+		if l := len(store.chunks[key]); l > chunkMaxSize {
+			t.Errorf("chunk %s is %d bytes, larger than max", key, l)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := tools.Reassemble(manifest, &out, store); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("reassembled data does not match the original")
+	}
+
+	stored := len(store.chunks)
+
+	// shifting the content must only affect the chunks around the edit
+	shifted := append([]byte("prefix"), data...)
+	if _, err := tools.ChunkAndStore(bytes.NewReader(shifted), store); err != nil {
+		t.Fatal(err)
+	}
+
+	if added := len(store.chunks) - stored; added > 2 {
+		t.Errorf("expected shifted data to dedup against stored chunks, %d new chunks stored", added)
+	}
+}
+
+func TestTools_ReassembleCorrupted(t *testing.T) {
+	var tools Tools
+
+	store := &memoryChunkStore{chunks: make(map[string][]byte)}
+
+	manifest, err := tools.ChunkAndStore(bytes.NewReader([]byte("some small payload")), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.chunks[manifest[0]] = []byte("tampered")
+
+	if err := tools.Reassemble(manifest, &bytes.Buffer{}, store); err == nil {
+		t.Error("expected error for corrupted chunk")
+	}
+}
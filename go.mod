@@ -1,3 +1,16 @@
 module github.com/zxbass/toolkit
 
 go 1.25.5
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/nyaruka/phonenumbers v1.6.10
+	golang.org/x/crypto v0.54.0
+	golang.org/x/sync v0.22.0
+	golang.org/x/text v0.40.0
+)
+
+require (
+	golang.org/x/exp v0.0.0-20250305212735-054e65f0b394 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
+)
@@ -0,0 +1,187 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+var isoDurationRe = regexp.MustCompile(
+	`^(-)?P(?:(\d+(?:[.,]\d+)?)Y)?(?:(\d+(?:[.,]\d+)?)M)?(?:(\d+(?:[.,]\d+)?)W)?(?:(\d+(?:[.,]\d+)?)D)?` +
+		`(?:T(?:(\d+(?:[.,]\d+)?)H)?(?:(\d+(?:[.,]\d+)?)M)?(?:(\d+(?:[.,]\d+)?)S)?)?$`,
+)
+
+func isSet(s string) bool {
+	return s != ""
+}
+
+type ISODuration struct {
+	time.Duration
+}
+
+func ParseISODuration(s string) (time.Duration, error) {
+	m := isoDurationRe.FindStringSubmatch(s)
+	if m == nil || !slices.ContainsFunc(m[2:], isSet) {
+		return 0, fmt.Errorf("%q is not a valid ISO 8601 duration", s)
+	}
+
+	// a time designator needs at least one time component after it
+	if strings.Contains(s, "T") && !slices.ContainsFunc(m[6:], isSet) {
+		return 0, fmt.Errorf("%q is not a valid ISO 8601 duration", s)
+	}
+
+	if m[2] != "" || m[3] != "" {
+		return 0, fmt.Errorf("duration %q uses years or months, which have no fixed length", s)
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+
+	var total float64
+	for i, unit := range units {
+		value := m[i+4]
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a valid ISO 8601 duration", s)
+		}
+
+		total += n * float64(unit)
+	}
+
+	if total > math.MaxInt64 {
+		return 0, fmt.Errorf("duration %q is too long", s)
+	}
+
+	d := time.Duration(math.Round(total))
+	if m[1] == "-" {
+		d = -d
+	}
+
+	return d, nil
+}
+
+func (d *ISODuration) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("ISO 8601 duration must be a string")
+	}
+
+	parsed, err := ParseISODuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = parsed
+	return nil
+}
+
+func (d ISODuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d ISODuration) String() string {
+	if d.Duration == 0 {
+		return "PT0S"
+	}
+
+	var b strings.Builder
+
+	rest := d.Duration
+	if rest < 0 {
+		b.WriteByte('-')
+		rest = -rest
+	}
+	b.WriteString("PT")
+
+	if h := rest / time.Hour; h > 0 {
+		fmt.Fprintf(&b, "%dH", h)
+		rest -= h * time.Hour
+	}
+
+	if m := rest / time.Minute; m > 0 {
+		fmt.Fprintf(&b, "%dM", m)
+		rest -= m * time.Minute
+	}
+
+	if rest > 0 {
+		b.WriteString(strconv.FormatFloat(rest.Seconds(), 'f', -1, 64) + "S")
+	}
+
+	return b.String()
+}
+
+// DefaultPhoneRegion is the region assumed for phone numbers written without
+// a leading + and country code.
+var DefaultPhoneRegion = "US"
+
+type PhoneNumber string
+
+func ParsePhoneNumber(s, region string) (PhoneNumber, error) {
+	num, err := phonenumbers.Parse(s, region)
+	if err != nil || !phonenumbers.IsValidNumber(num) {
+		return "", fmt.Errorf("%q is not a valid phone number", s)
+	}
+
+	return PhoneNumber(phonenumbers.Format(num, phonenumbers.E164)), nil
+}
+
+func (p *PhoneNumber) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("phone number must be a string")
+	}
+
+	parsed, err := ParsePhoneNumber(s, DefaultPhoneRegion)
+	if err != nil {
+		return err
+	}
+
+	*p = parsed
+	return nil
+}
+
+type UTCTime struct {
+	time.Time
+}
+
+func (u *UTCTime) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("time must be an RFC 3339 string")
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return fmt.Errorf("%q is not an RFC 3339 time", s)
+	}
+
+	u.Time = parsed.UTC()
+	return nil
+}
+
+func (u UTCTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(u.Time.UTC().Format(time.RFC3339Nano))
+}
@@ -0,0 +1,190 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var isoDurationTests = []struct {
+	name          string
+	input         string
+	expected      time.Duration
+	errorExpected bool
+}{
+	{name: "hours and minutes", input: "PT1H30M", expected: 90 * time.Minute},
+	{name: "seconds", input: "PT45S", expected: 45 * time.Second},
+	{name: "fractional seconds", input: "PT0.5S", expected: 500 * time.Millisecond},
+	{name: "comma fraction", input: "PT1,5H", expected: 90 * time.Minute},
+	{name: "days", input: "P2D", expected: 48 * time.Hour},
+	{name: "weeks", input: "P1W", expected: 7 * 24 * time.Hour},
+	{name: "days and time", input: "P1DT2H", expected: 26 * time.Hour},
+	{name: "negative", input: "-PT10M", expected: -10 * time.Minute},
+	{name: "zero", input: "PT0S", expected: 0},
+	{name: "go format", input: "1h30m", errorExpected: true},
+	{name: "empty designator", input: "P", errorExpected: true},
+	{name: "dangling T", input: "P1DT", errorExpected: true},
+	{name: "months", input: "P1M", errorExpected: true},
+	{name: "years", input: "P1Y", errorExpected: true},
+	{name: "minutes outside time", input: "PT", errorExpected: true},
+	{name: "negative empty designator", input: "-P", errorExpected: true},
+	{name: "negative empty time", input: "-PT", errorExpected: true},
+	{name: "negative dangling T", input: "-P1DT", errorExpected: true},
+}
+
+func TestParseISODuration(t *testing.T) {
+	for _, test := range isoDurationTests {
+		d, err := ParseISODuration(test.input)
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if d != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, d)
+		}
+	}
+}
+
+func TestISODuration_JSON(t *testing.T) {
+	var tools Tools
+
+	var payload struct {
+		Timeout ISODuration `json:"timeout"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"timeout": "PT1H30M"}`))
+	if err := tools.ReadJSON(httptest.NewRecorder(), req, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Timeout.Duration != 90*time.Minute {
+		t.Errorf("expected 1h30m, got %s", payload.Timeout)
+	}
+
+	out, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != `{"timeout":"PT1H30M"}` {
+		t.Errorf("unexpected encoding %s", out)
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"timeout": "1h30m"}`))
+	if err := tools.ReadJSON(httptest.NewRecorder(), req, &payload); err == nil {
+		t.Error("expected error for non-ISO duration")
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"timeout": 5}`))
+	if err := tools.ReadJSON(httptest.NewRecorder(), req, &payload); err == nil {
+		t.Error("expected error for numeric duration")
+	}
+}
+
+var phoneNumberTests = []struct {
+	name          string
+	input         string
+	region        string
+	expected      PhoneNumber
+	errorExpected bool
+}{
+	{name: "national format", input: "(202) 456-1111", region: "US", expected: "+12024561111"},
+	{name: "already E.164", input: "+442079460958", region: "US", expected: "+442079460958"},
+	{name: "international with spaces", input: "+44 20 7946 0958", region: "US", expected: "+442079460958"},
+	{name: "other region", input: "020 7946 0958", region: "GB", expected: "+442079460958"},
+	{name: "too short", input: "12345", region: "US", errorExpected: true},
+	{name: "letters", input: "call me", region: "US", errorExpected: true},
+	{name: "empty", input: "", region: "US", errorExpected: true},
+}
+
+func TestParsePhoneNumber(t *testing.T) {
+	for _, test := range phoneNumberTests {
+		p, err := ParsePhoneNumber(test.input, test.region)
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if p != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, p)
+		}
+	}
+}
+
+func TestPhoneNumber_JSON(t *testing.T) {
+	var tools Tools
+
+	var payload struct {
+		Phone PhoneNumber `json:"phone"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"phone": "202-456-1111"}`))
+	if err := tools.ReadJSON(httptest.NewRecorder(), req, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Phone != "+12024561111" {
+		t.Errorf("expected +12024561111, got %s", payload.Phone)
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"phone": "555"}`))
+	if err := tools.ReadJSON(httptest.NewRecorder(), req, &payload); err == nil {
+		t.Error("expected error for invalid phone number")
+	}
+}
+
+var utcTimeTests = []struct {
+	name          string
+	input         string
+	expected      string
+	errorExpected bool
+}{
+	{name: "utc", input: `"2024-03-01T12:00:00Z"`, expected: "2024-03-01T12:00:00Z"},
+	{name: "positive offset", input: `"2024-03-01T14:30:00+02:30"`, expected: "2024-03-01T12:00:00Z"},
+	{name: "negative offset across midnight", input: `"2024-02-29T19:00:00-05:00"`, expected: "2024-03-01T00:00:00Z"},
+	{name: "fractional seconds", input: `"2024-03-01T12:00:00.25+01:00"`, expected: "2024-03-01T11:00:00.25Z"},
+	{name: "no offset", input: `"2024-03-01T12:00:00"`, errorExpected: true},
+	{name: "date only", input: `"2024-03-01"`, errorExpected: true},
+	{name: "number", input: `1709294400`, errorExpected: true},
+}
+
+func TestUTCTime_JSON(t *testing.T) {
+	for _, test := range utcTimeTests {
+		var u UTCTime
+
+		err := json.Unmarshal([]byte(test.input), &u)
+		if test.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, none received", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if u.Location() != time.UTC {
+			t.Errorf("%s: expected UTC location, got %s", test.name, u.Location())
+		}
+
+		out, err := json.Marshal(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(out) != `"`+test.expected+`"` {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, out)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package toolkit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	var tools Tools
+
+	now := time.Now()
+	limiter := tools.NewRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := range 3 {
+		if !limiter.Allow("client") {
+			t.Fatalf("request %d within burst was refused", i)
+		}
+	}
+
+	if limiter.Allow("client") {
+		t.Error("request past the burst was allowed")
+	}
+
+	if !limiter.Allow("other") {
+		t.Error("keys should have independent buckets")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !limiter.Allow("client") {
+		t.Error("expected one token after half a second at 2 per second")
+	}
+
+	if limiter.Allow("client") {
+		t.Error("only one token should have been refilled")
+	}
+
+	now = now.Add(time.Hour)
+	for i := range 3 {
+		if !limiter.Allow("client") {
+			t.Fatalf("request %d after refill was refused", i)
+		}
+	}
+
+	if limiter.Allow("client") {
+		t.Error("refill must not exceed the burst")
+	}
+}
+
+func TestRateLimiter_Sweep(t *testing.T) {
+	var tools Tools
+
+	now := time.Now()
+	limiter := tools.NewRateLimiter(0.05, 5)
+	limiter.now = func() time.Time { return now }
+
+	limiter.Allow("idle")
+	for range 5 {
+		limiter.Allow("busy")
+	}
+
+	now = now.Add(rateLimiterSweepInterval - time.Second)
+	limiter.Allow("busy")
+
+	now = now.Add(time.Second)
+	limiter.Allow("trigger")
+
+	if _, ok := limiter.buckets["idle"]; ok {
+		t.Error("idle key should have been swept")
+	}
+
+	if _, ok := limiter.buckets["busy"]; !ok {
+		t.Error("key with a partly drained bucket should be kept")
+	}
+}
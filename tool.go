@@ -1,26 +1,77 @@
 package toolkit
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"maps"
+	"math"
 	"math/rand/v2"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/netip"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/language"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
-	randStrBytes       = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_")
-	randStrLen         = len(randStrBytes)
-	defaultMaxFileSize = 1024 * 1024 * 1024
+	randStrBytes        = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_")
+	randStrLen          = len(randStrBytes)
+	qrAlphanumericBytes = []byte("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:")
+	crockfordBase32     = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	defaultMaxFileSize  = 1024 * 1024 * 1024
+
+	defaultMaxFilenameLength = 255
+	defaultBcryptCost        = 12
+
+	ndjsonFlushInterval = 100 * time.Millisecond
 
 	rng = rand.NewPCG(
 		uint64(time.Now().UnixNano()),
@@ -29,14 +80,236 @@ var (
 	mu sync.Mutex
 )
 
+var slugRe = regexp.MustCompile(`[^a-z\d]+`)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+var ErrReadTimeout = errors.New("timed out reading request body")
+
+var ErrUnsupportedMediaType = errors.New("unsupported content type")
+
+var ErrResponseTooLarge = errors.New("response too large")
+
+var ErrBodyTooLarge = errors.New("body too large")
+
+var mediaTopLevelTypes = []string{
+	"application", "audio", "font", "image", "message", "model", "multipart", "text", "video",
+}
+
 type Tools struct {
-	MaxFileSize            int
-	AllowedFileTypes       []string
-	MaxJSONSize            int
-	JSONAllowUnknownFields bool
+	MaxFileSize             int
+	MaxUploadFileSize       int64
+	AllowedFileTypes        []string
+	FieldFileTypes          map[string][]string
+	FileSignatures          map[string][][]byte
+	MaxJSONSize             int
+	JSONAllowUnknownFields  bool
+	JSONUseNumber           bool
+	UploadFieldName         string
+	MaxFilenameLength       int
+	MaxDirSize              int64
+	RequireFileExtension    bool
+	BcryptCost              int
+	ProductionMode          bool
+	ValidatePDFUploads      bool
+	SlowThreshold           time.Duration
+	Logger                  Logger
+	AlwaysEnvelope          bool
+	RequireHTTPS            bool
+	CopyBufferSize          int
+	StripBOM                bool
+	ResponseTransformer     func(any) any
+	MaxResponseSize         int
+	ScanFunc                func(name string, r io.Reader) error
+	ZipSkipMissing          bool
+	EnvelopeFunc            func(JSONResponse) any
+	ExpectedSize            func(r *http.Request, hdr *multipart.FileHeader) (int64, bool)
+	Debug                   bool
+	RejectPolyglots         bool
+	DuplicateFileNames      DuplicatePolicy
+	ValidateCSVUploads      bool
+	CSVRequiredHeaders      []string
+	CSVMaxRows              int
+	ChecksumUploads         bool
+	HTTPTimeout             time.Duration
+	HTTPMaxIdleConns        int
+	HTTPMaxIdleConnsPerHost int
+	HTTPIdleConnTimeout     time.Duration
+	SanitizeSVGUploads      bool
+	AllowedExtensions       []string
+	UploadProgress          func(name string, read, total int64)
+
+	source *rand.PCG
+	state  *toolState
+}
+
+// toolState holds what Tools accumulates at run time. It lives behind a
+// pointer so Tools stays a plain value that can be copied; copies made
+// after first use share the state.
+type toolState struct {
+	stats       toolStats
+	copyBufPool sync.Pool
+	gzipPool    sync.Pool
+	pushGroup   singleflight.Group
+	clientOnce  sync.Once
+	client      *http.Client
+}
+
+// runtimeState returns the state, creating it on first use. The field is
+// read and set atomically; an atomic.Pointer field would carry a noCopy
+// marker and make go vet reject copies of Tools.
+func (t *Tools) runtimeState() *toolState {
+	addr := (*unsafe.Pointer)(unsafe.Pointer(&t.state))
+
+	if state := (*toolState)(atomic.LoadPointer(addr)); state != nil {
+		return state
+	}
+
+	// concurrent first calls race to install their state; the loser
+	// uses the winner's
+	atomic.CompareAndSwapPointer(addr, nil, unsafe.Pointer(&toolState{}))
+
+	return (*toolState)(atomic.LoadPointer(addr))
+}
+
+type Logger interface {
+	Warn(msg string, args ...any)
+}
+
+type OperationStats struct {
+	Count   int64
+	Total   time.Duration
+	Average time.Duration
+}
+
+type Stats struct {
+	Uploads      OperationStats
+	JSONReads    OperationStats
+	JSONWrites   OperationStats
+	RemotePushes OperationStats
+}
+
+type opCounter struct {
+	count atomic.Int64
+	nanos atomic.Int64
+}
+
+func (c *opCounter) snapshot() OperationStats {
+	s := OperationStats{
+		Count: c.count.Load(),
+		Total: time.Duration(c.nanos.Load()),
+	}
+
+	if s.Count > 0 {
+		s.Average = s.Total / time.Duration(s.Count)
+	}
+
+	return s
+}
+
+type toolStats struct {
+	uploads      opCounter
+	jsonReads    opCounter
+	jsonWrites   opCounter
+	remotePushes opCounter
+}
+
+func (t *Tools) Stats() Stats {
+	stats := &t.runtimeState().stats
+
+	return Stats{
+		Uploads:      stats.uploads.snapshot(),
+		JSONReads:    stats.jsonReads.snapshot(),
+		JSONWrites:   stats.jsonWrites.snapshot(),
+		RemotePushes: stats.remotePushes.snapshot(),
+	}
+}
+
+func (t *Tools) observe(op string, start time.Time) {
+	elapsed := time.Since(start)
+
+	stats := &t.runtimeState().stats
+
+	var counter *opCounter
+	switch op {
+	case "upload":
+		counter = &stats.uploads
+	case "read_json":
+		counter = &stats.jsonReads
+	case "write_json":
+		counter = &stats.jsonWrites
+	case "push_json":
+		counter = &stats.remotePushes
+	}
+
+	if counter != nil {
+		counter.count.Add(1)
+		counter.nanos.Add(int64(elapsed))
+	}
+
+	if t.Logger == nil || t.SlowThreshold <= 0 {
+		return
+	}
+
+	if elapsed > t.SlowThreshold {
+		t.Logger.Warn("slow operation", "op", op, "duration", elapsed)
+	}
+}
+
+func (t *Tools) ValidateConfig() error {
+	var errs []error
+
+	for _, allowed := range t.AllowedFileTypes {
+		mediaType, _, err := mime.ParseMediaType(allowed)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("allowed file type %q is malformed: %w", allowed, err))
+			continue
+		}
+
+		topLevel, subType, ok := strings.Cut(mediaType, "/")
+		if !ok || subType == "" {
+			errs = append(errs, fmt.Errorf("allowed file type %q is missing a subtype", allowed))
+			continue
+		}
+
+		if !slices.Contains(mediaTopLevelTypes, topLevel) {
+			errs = append(errs, fmt.Errorf("allowed file type %q has unknown top-level type %q", allowed, topLevel))
+		}
+	}
+
+	if t.MaxFileSize < 0 {
+		errs = append(errs, errors.New("max file size must not be negative"))
+	}
+
+	if t.MaxJSONSize < 0 {
+		errs = append(errs, errors.New("max JSON size must not be negative"))
+	}
+
+	if t.MaxFilenameLength < 0 {
+		errs = append(errs, errors.New("max filename length must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t *Tools) SeedRandom(seed uint64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	t.source = rand.NewPCG(seed, seed)
 }
 
 func (t *Tools) RandomString(n int) string {
+	return t.randomFromAlphabet(n, randStrBytes)
+}
+
+func (t *Tools) RandomQRAlphanumeric(n int) string {
+	return t.randomFromAlphabet(n, qrAlphanumericBytes)
+}
+
+// randomFromAlphabet draws 6 bits per character and rejects values past the
+// end of the alphabet, so alphabets of up to 64 characters stay unbiased
+func (t *Tools) randomFromAlphabet(n int, alphabet []byte) string {
 	if n <= 0 {
 		return ""
 	}
@@ -46,12 +319,17 @@ func (t *Tools) RandomString(n int) string {
 	mu.Lock()
 	defer mu.Unlock()
 
+	src := rng
+	if t.source != nil {
+		src = t.source
+	}
+
 	var val uint64
 	var bits uint = 0
 
 	for i := 0; i < n; {
 		if bits < 6 {
-			val = rng.Uint64()
+			val = src.Uint64()
 			bits = 64
 		}
 
@@ -59,23 +337,64 @@ func (t *Tools) RandomString(n int) string {
 		val >>= 6
 		bits -= 6
 
-		if idx == 63 {
+		if idx >= len(alphabet) {
 			continue
 		}
 
-		b[i] = randStrBytes[idx]
+		b[i] = alphabet[idx]
 		i++
 	}
 
 	return string(b)
 }
 
+func (t *Tools) GenerateID() string {
+	var id [26]byte
+
+	ms := uint64(time.Now().UnixMilli())
+	for i := 9; i >= 0; i-- {
+		id[i] = crockfordBase32[ms&0x1F]
+		ms >>= 5
+	}
+
+	// 16 base32 characters hold exactly 80 random bits
+	random := secureRandomBytes(10)
+	var bits, n uint
+	for i, j := 0, 10; j < len(id); j++ {
+		for n < 5 {
+			bits = bits<<8 | uint(random[i])
+			n += 8
+			i++
+		}
+		n -= 5
+		id[j] = crockfordBase32[(bits>>n)&0x1F]
+	}
+
+	return string(id[:])
+}
+
+func secureRandomBytes(n int) []byte {
+	b := make([]byte, n)
+	crand.Read(b)
+	return b
+}
+
 type UploadedFile struct {
-	NewFileName      string
-	OriginalFileName string
-	FileSize         int64
+	NewFileName       string `json:"new_file_name"`
+	OriginalFileName  string `json:"original_file_name"`
+	SubmittedFileName string `json:"submitted_file_name,omitempty"`
+	FileSize          int64  `json:"file_size"`
+	Checksum          string `json:"checksum,omitempty"`
 }
 
+type DuplicatePolicy int
+
+const (
+	DuplicatesAllow DuplicatePolicy = iota
+	DuplicatesReject
+	DuplicatesRename
+)
+
 func (t *Tools) UploadFile(r *http.Request, uploadDir string, rename ...bool) (*UploadedFile, error) {
 	renameFile := true
 	if len(rename) > 0 {
@@ -87,6 +406,10 @@ func (t *Tools) UploadFile(r *http.Request, uploadDir string, rename ...bool) (*
 		return nil, err
 	}
 
+	if len(uploadedFiles) == 0 {
+		return nil, errors.New("no files uploaded")
+	}
+
 	return uploadedFiles[0], nil
 }
 
@@ -96,12 +419,90 @@ func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) (
 		renameFile = rename[0]
 	}
 
-	var uploadedFiles []*UploadedFile
+	result, err := t.uploadFiles(r, uploadDir, renameFile, false)
+	if err != nil {
+		// files stored before the failure stay on disk, so report them
+		if result != nil {
+			return result.Files, err
+		}
+		return nil, err
+	}
+
+	return result.Files, nil
+}
+
+type RejectedFile struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+type UploadResult struct {
+	Files    []*UploadedFile `json:"files"`
+	Rejected []RejectedFile  `json:"rejected,omitempty"`
+}
+
+func (t *Tools) UploadFilesBestEffort(r *http.Request, uploadDir string, rename ...bool) (*UploadResult, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	return t.uploadFiles(r, uploadDir, renameFile, true)
+}
+
+type uploadBatch struct {
+	request           *http.Request
+	dir               string
+	rename            bool
+	maxFilenameLength int
+	dirSize           int64
+	seen              map[string]bool
+}
+
+func (b *uploadBatch) claimName(name string, policy DuplicatePolicy) (string, error) {
+	if policy == DuplicatesAllow {
+		return name, nil
+	}
+
+	if b.seen == nil {
+		b.seen = make(map[string]bool)
+	}
+
+	unique := name
+	if b.seen[name] {
+		if policy == DuplicatesReject {
+			return "", fmt.Errorf("duplicate file name %s in upload", name)
+		}
+
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for i := 1; b.seen[unique]; i++ {
+			unique = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+	}
+
+	b.seen[unique] = true
+
+	return unique, nil
+}
+
+func (t *Tools) uploadFiles(r *http.Request, uploadDir string, renameFile, bestEffort bool) (*UploadResult, error) {
+	defer t.observe("upload", time.Now())
 
 	if t.MaxFileSize == 0 {
 		t.MaxFileSize = defaultMaxFileSize
 	}
 
+	batch := uploadBatch{
+		request:           r,
+		dir:               uploadDir,
+		rename:            renameFile,
+		maxFilenameLength: t.MaxFilenameLength,
+	}
+	if batch.maxFilenameLength <= 0 {
+		batch.maxFilenameLength = defaultMaxFilenameLength
+	}
+
 	err := r.ParseMultipartForm(int64(t.MaxFileSize))
 	if err != nil {
 		return nil, errors.New("uploaded file is too big")
@@ -111,240 +512,3645 @@ func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) (
 		return nil, err
 	}
 
-	for _, fHeaders := range r.MultipartForm.File {
-		for _, hdr := range fHeaders {
-			uploadedFiles, err = func([]*UploadedFile) ([]*UploadedFile, error) {
-				var uploadedFile UploadedFile
+	if t.MaxDirSize > 0 {
+		if batch.dirSize, err = t.DirSize(uploadDir); err != nil {
+			return nil, err
+		}
+	}
 
-				infile, err := hdr.Open()
-				if err != nil {
-					return nil, err
-				}
-				defer infile.Close()
+	files := r.MultipartForm.File
+	if t.UploadFieldName != "" {
+		fHeaders, ok := files[t.UploadFieldName]
+		if !ok {
+			return nil, fmt.Errorf("no files uploaded in field %s", t.UploadFieldName)
+		}
+		files = map[string][]*multipart.FileHeader{t.UploadFieldName: fHeaders}
+	}
 
-				buf := make([]byte, 512)
-				_, err = infile.Read(buf)
-				if err != nil {
-					return nil, err
-				}
+	var result UploadResult
 
-				allowed := false
-				fileType := http.DetectContentType(buf)
-
-				if len(t.AllowedFileTypes) > 0 {
-					for _, t := range t.AllowedFileTypes {
-						if strings.EqualFold(fileType, t) {
-							allowed = true
-							break
-						}
-					}
-				} else {
-					allowed = true
+	for _, field := range slices.Sorted(maps.Keys(files)) {
+		for _, hdr := range files[field] {
+			uploadedFile, err := t.storeUpload(field, hdr, &batch)
+			if err != nil {
+				if !bestEffort {
+					return &result, err
 				}
 
-				if !allowed {
-					return nil, errors.New("uploaded file type is not permitted")
-				}
+				result.Rejected = append(result.Rejected, RejectedFile{Name: hdr.Filename, Reason: err.Error()})
+				continue
+			}
 
-				_, err = infile.Seek(0, 0)
-				if err != nil {
-					return nil, err
-				}
+			result.Files = append(result.Files, uploadedFile)
+		}
+	}
 
-				if renameFile {
-					uploadedFile.NewFileName = fmt.Sprintf(
-						"%s%s",
-						t.RandomString(25),
-						filepath.Ext(hdr.Filename),
-					)
-				} else {
-					uploadedFile.NewFileName = hdr.Filename
-				}
+	return &result, nil
+}
 
-				var outfile *os.File
-				defer outfile.Close()
+func (t *Tools) storeUpload(field string, hdr *multipart.FileHeader, batch *uploadBatch) (*UploadedFile, error) {
+	var uploadedFile UploadedFile
 
-				if outfile, err = os.Create(filepath.Join(uploadDir, uploadedFile.NewFileName)); err != nil {
-					return nil, err
-				}
+	originalName, err := batch.claimName(hdr.Filename, t.DuplicateFileNames)
+	if err != nil {
+		return nil, err
+	}
 
-				fileSize, err := io.Copy(outfile, infile)
-				if err != nil {
-					return nil, err
-				}
+	if t.RequireFileExtension && !batch.rename && filepath.Ext(hdr.Filename) == "" {
+		return nil, errors.New("uploaded file must have an extension")
+	}
 
-				uploadedFile.FileSize = fileSize
-				uploadedFile.OriginalFileName = hdr.Filename
-				uploadedFiles = append(uploadedFiles, &uploadedFile)
+	if t.MaxUploadFileSize > 0 && hdr.Size > t.MaxUploadFileSize {
+		return nil, fmt.Errorf("uploaded file must not be larger than %d bytes", t.MaxUploadFileSize)
+	}
 
-				return uploadedFiles, nil
-			}(uploadedFiles)
-			if err != nil {
-				return uploadedFiles, err
-			}
-		}
+	if t.MaxDirSize > 0 && batch.dirSize+hdr.Size > t.MaxDirSize {
+		return nil, errors.New("upload directory quota exceeded")
 	}
 
-	return uploadedFiles, nil
-}
+	infile, err := hdr.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer infile.Close()
 
-func (t *Tools) CreateDirIfNotExists(path string) error {
-	const mode = 0755
+	buf := make([]byte, 512)
+	n, err := infile.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:n]
 
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		err := os.MkdirAll(path, mode)
-		if err != nil {
-			return err
-		}
+	fileType := http.DetectContentType(buf)
+
+	if !t.isAllowedFileType(fileType, field) {
+		return nil, errors.New("uploaded file type is not permitted")
 	}
-	return nil
-}
 
-func (t *Tools) Slugify(s string) (string, error) {
-	if len(s) == 0 {
-		return "", errors.New("string should not be empty")
+	if signatures, ok := t.FileSignatures[fileType]; ok && !t.MatchMagicBytes(buf, signatures) {
+		return nil, errors.New("uploaded file does not match the expected signature for its type")
 	}
 
-	var re = regexp.MustCompile(`[^a-z\d]+`)
+	if t.ValidatePDFUploads && fileType == "application/pdf" {
+		if _, err = infile.Seek(0, 0); err != nil {
+			return nil, err
+		}
 
-	slug := strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
+		if err := t.ValidatePDF(infile); err != nil {
+			return nil, err
+		}
+	}
 
-	if len(slug) == 0 {
-		return "", errors.New("given string produces empty slug")
+	if t.RejectPolyglots && strings.HasPrefix(fileType, "image/") {
+		if _, err = infile.Seek(0, 0); err != nil {
+			return nil, err
+		}
+
+		suspicious, err := t.CheckPolyglot(infile)
+		if err != nil {
+			return nil, err
+		}
+		if suspicious {
+			return nil, errors.New("uploaded image contains embedded markup or an archive")
+		}
 	}
 
-	return slug, nil
-}
+	var sanitized []byte
+	var sanitizedFrom int64
+	if t.SanitizeSVGUploads && isSVG(buf, fileType, hdr.Filename) {
+		if _, err = infile.Seek(0, 0); err != nil {
+			return nil, err
+		}
 
-func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, path, fileName, displayName string) {
-	fp := filepath.Join(path, fileName)
+		if sanitized, err = t.SanitizeSVG(infile); err != nil {
+			return nil, err
+		}
 
-	w.Header().Set(
-		"Content-Disposition",
-		fmt.Sprintf("attachment; filename=\"%s\"", url.QueryEscape(displayName)),
-	)
+		if sanitizedFrom, err = infile.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
 
-	http.ServeFile(w, r, fp)
-}
+	// text sniffing cannot tell CSV apart from other plain text,
+	// so the extension decides which files get checked
+	if t.ValidateCSVUploads && strings.HasPrefix(fileType, "text/") && strings.EqualFold(filepath.Ext(hdr.Filename), ".csv") {
+		if _, err = infile.Seek(0, 0); err != nil {
+			return nil, err
+		}
 
-type JSONResponse struct {
-	Error   bool   `json:"error"`
-	Message string `json:"message"`
-	Data    any    `json:"data,omitempty"`
-}
+		if _, err := t.ValidateCSV(infile, t.CSVRequiredHeaders, t.CSVMaxRows); err != nil {
+			return nil, err
+		}
+	}
 
-func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data any) error {
-	maxBytes := t.MaxJSONSize
-	if maxBytes == 0 {
-		maxBytes = 1024 * 1024
+	var offset int64
+	if t.StripBOM && strings.HasPrefix(fileType, "text/") && bytes.HasPrefix(buf, utf8BOM) {
+		offset = int64(len(utf8BOM))
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
-	dec := json.NewDecoder(r.Body)
+	_, err = infile.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
 
-	if !t.JSONAllowUnknownFields {
-		dec.DisallowUnknownFields()
+	if batch.rename {
+		uploadedFile.NewFileName = fmt.Sprintf(
+			"%s%s",
+			t.RandomString(25),
+			t.uploadExtension(hdr.Filename, fileType),
+		)
+	} else {
+		uploadedFile.NewFileName = originalName
 	}
 
-	err := dec.Decode(data)
+	uploadedFile.NewFileName = truncateFileName(uploadedFile.NewFileName, batch.maxFilenameLength)
+
+	dst := filepath.Join(batch.dir, uploadedFile.NewFileName)
+
+	outfile, err := os.Create(dst)
 	if err != nil {
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var invalidUnmarshalError *json.InvalidUnmarshalError
+		return nil, err
+	}
+	defer outfile.Close()
 
-		switch {
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly formed JSON at character %d", syntaxError.Offset)
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly formed JSON")
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %v", &unmarshalTypeError.Field)
-			}
-			return fmt.Errorf("body contains incorrect JSON type at character %d", unmarshalTypeError.Offset)
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
-		case strings.HasPrefix(err.Error(), "json: unknown field"):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
-		case errors.As(err, &invalidUnmarshalError):
-			return fmt.Errorf("error unmarshalling JSON: %s", err.Error())
-		default:
-			return err
+	var src io.Reader = infile
+	if sanitized != nil {
+		src = bytes.NewReader(sanitized)
+	}
+	if t.UploadProgress != nil {
+		total := hdr.Size - offset
+		if sanitized != nil {
+			total = int64(len(sanitized))
 		}
+		src = t.NewProgressReader(src, total, func(read, total int64) {
+			t.UploadProgress(originalName, read, total)
+		})
+	}
+	if t.MaxUploadFileSize > 0 {
+		// hdr.Size comes from the parsed form and should be right, but
+		// never copy more than one byte past the limit regardless
+		src = io.LimitReader(src, t.MaxUploadFileSize+1)
 	}
 
-	err = dec.Decode(&struct{}{})
-	if err != io.EOF {
-		return errors.New("body must contain exactly one JSON object")
+	var dstWriter io.Writer = outfile
+	var checksum hash.Hash
+	if t.ChecksumUploads {
+		checksum = sha256.New()
+		dstWriter = io.MultiWriter(outfile, checksum)
 	}
 
-	return nil
-}
+	fileSize, err := t.copyUpload(dstWriter, src)
+	if err == nil && t.MaxUploadFileSize > 0 && fileSize > t.MaxUploadFileSize {
+		err = fmt.Errorf("uploaded file must not be larger than %d bytes", t.MaxUploadFileSize)
+	}
+	if err == nil && t.ExpectedSize != nil && batch.request != nil {
+		// compare what was received, not what was written: StripBOM and
+		// SanitizeSVGUploads both change the stored size
+		received := sanitizedFrom
+		if sanitized == nil {
+			received, err = infile.Seek(0, io.SeekCurrent)
+		}
 
-func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data any, headers ...http.Header) error {
-	out, err := json.Marshal(data)
+		if expected, ok := t.ExpectedSize(batch.request, hdr); err == nil && ok && received != expected {
+			err = fmt.Errorf("uploaded file is incomplete: received %d bytes, expected %d", received, expected)
+		}
+	}
 	if err != nil {
-		return err
+		outfile.Close()
+		os.Remove(dst)
+		return nil, err
 	}
 
-	if len(headers) > 0 {
-		for k, v := range headers[0] {
-			w.Header()[k] = v
+	if t.ScanFunc != nil {
+		if _, err := outfile.Seek(0, io.SeekStart); err != nil {
+			outfile.Close()
+			os.Remove(dst)
+			return nil, err
+		}
+
+		if err := t.ScanFunc(originalName, outfile); err != nil {
+			outfile.Close()
+			os.Remove(dst)
+			return nil, fmt.Errorf("uploaded file rejected by scan: %w", err)
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
+	batch.dirSize += fileSize
 
-	_, err = w.Write(out)
-	if err != nil {
-		return err
+	uploadedFile.FileSize = fileSize
+	uploadedFile.OriginalFileName = originalName
+	if checksum != nil {
+		uploadedFile.Checksum = hex.EncodeToString(checksum.Sum(nil))
+	}
+	if originalName != hdr.Filename {
+		uploadedFile.SubmittedFileName = hdr.Filename
 	}
 
-	return nil
+	return &uploadedFile, nil
 }
 
-func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
-	statusCode := http.StatusBadRequest
-
-	if len(status) > 0 {
-		statusCode = status[0]
+func (t *Tools) uploadExtension(filename, fileType string) string {
+	ext := filepath.Ext(filename)
+	if len(t.AllowedExtensions) == 0 {
+		return ext
 	}
 
-	var payload = JSONResponse{
-		Error:   true,
-		Message: err.Error(),
+	allowed := func(ext string) bool {
+		return ext != "" && slices.ContainsFunc(t.AllowedExtensions, func(a string) bool {
+			return strings.EqualFold("."+strings.TrimPrefix(a, "."), ext)
+		})
 	}
 
-	return t.WriteJSON(w, statusCode, payload)
-}
+	if allowed(ext) {
+		return ext
+	}
+
+	// fall back to an allowed extension for the sniffed type, or none at all
+	mediaType, _, _ := mime.ParseMediaType(fileType)
+	candidates, _ := mime.ExtensionsByType(mediaType)
+	for _, candidate := range candidates {
+		if allowed(candidate) {
+			return candidate
+		}
+	}
+
+	return ""
+}
+
+func (t *Tools) copyUpload(dst io.Writer, src io.Reader) (int64, error) {
+	// parts spilled to disk are copied file to file by the kernel,
+	// which beats any user space buffer
+	if _, isFile := src.(*os.File); isFile || t.CopyBufferSize <= 0 {
+		return io.Copy(dst, src)
+	}
+
+	pool := &t.runtimeState().copyBufPool
+
+	buf, ok := pool.Get().(*[]byte)
+	if !ok || len(*buf) != t.CopyBufferSize {
+		b := make([]byte, t.CopyBufferSize)
+		buf = &b
+	}
+	defer pool.Put(buf)
+
+	// hide ReaderFrom and WriterTo so the configured buffer is actually used
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+func (t *Tools) StreamUploads(r *http.Request, handler func(part *multipart.Part) error) error {
+	defer t.observe("upload", time.Now())
+
+	maxSize := t.MaxFileSize
+	if maxSize == 0 {
+		maxSize = defaultMaxFileSize
+	}
+
+	r.Body = http.MaxBytesReader(nil, r.Body, int64(maxSize))
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		err = handler(part)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (t *Tools) RelayUpload(r *http.Request, uri string, client ...*http.Client) (*http.Response, error) {
+	defer t.observe("upload", time.Now())
+
+	if err := t.checkRemoteURI(uri); err != nil {
+		return nil, err
+	}
+
+	if t.MaxFileSize == 0 {
+		t.MaxFileSize = defaultMaxFileSize
+	}
+	r.Body = http.MaxBytesReader(nil, r.Body, int64(t.MaxFileSize))
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	var part *multipart.Part
+	for {
+		part, err = reader.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("no file uploaded")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FileName() != "" && (t.UploadFieldName == "" || part.FormName() == t.UploadFieldName) {
+			break
+		}
+		part.Close()
+	}
+	defer part.Close()
+
+	var body io.Reader = part
+	if t.MaxUploadFileSize > 0 {
+		body = &maxSizeReader{r: part, remaining: t.MaxUploadFileSize}
+	}
+
+	request, err := http.NewRequestWithContext(r.Context(), "POST", uri, body)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", cmp.Or(part.Header.Get("Content-Type"), "application/octet-stream"))
+	request.Header.Set("Content-Disposition", t.attachmentDisposition(part.FileName()))
+
+	return t.httpClient(client...).Do(request)
+}
+
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.remaining < 0 {
+		return 0, errors.New("uploaded file is too big")
+	}
+
+	p = p[:min(int64(len(p)), m.remaining+1)]
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		return 0, errors.New("uploaded file is too big")
+	}
+
+	return n, err
+}
+
+type uploadManifestEntry struct {
+	OriginalName string `json:"original_name"`
+	StoredName   string `json:"stored_name"`
+	Size         int64  `json:"size"`
+	Checksum     string `json:"checksum,omitempty"`
+}
+
+func (t *Tools) WriteUploadManifest(w io.Writer, files []*UploadedFile) error {
+	manifest := struct {
+		Files []uploadManifestEntry `json:"files"`
+	}{
+		Files: make([]uploadManifestEntry, 0, len(files)),
+	}
+
+	for _, file := range files {
+		if file == nil {
+			continue
+		}
+
+		manifest.Files = append(manifest.Files, uploadManifestEntry{
+			OriginalName: file.OriginalFileName,
+			StoredName:   file.NewFileName,
+			Size:         file.FileSize,
+			Checksum:     file.Checksum,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(manifest)
+}
+
+func (t *Tools) StoreContentAddressed(r io.Reader, dir string, ext string) (*UploadedFile, error) {
+	if err := t.CreateDirIfNotExists(dir); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+
+	fileSize, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	uploadedFile := UploadedFile{
+		NewFileName: checksum + ext,
+		FileSize:    fileSize,
+		Checksum:    checksum,
+	}
+
+	dst := filepath.Join(dir, uploadedFile.NewFileName)
+
+	if info, err := os.Stat(dst); err == nil {
+		uploadedFile.FileSize = info.Size()
+		return &uploadedFile, nil
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return nil, err
+	}
+
+	return &uploadedFile, nil
+}
+
+func (t *Tools) ValidatePDF(r io.Reader) error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != "%PDF-" {
+		return errors.New("file is not a PDF")
+	}
+
+	// the trailer may be followed by a little whitespace or garbage,
+	// so look for the marker anywhere in the last kilobyte
+	const tailSize = 1024
+	tail := make([]byte, 0, 2*tailSize)
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := r.Read(buf)
+		tail = append(tail, buf[:n]...)
+		if len(tail) > tailSize {
+			tail = append(tail[:0], tail[len(tail)-tailSize:]...)
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !bytes.Contains(tail, []byte("%%EOF")) {
+		return errors.New("PDF file is truncated or corrupt")
+	}
+
+	return nil
+}
+
+var polyglotMarkers = [][]byte{
+	[]byte("<script"),
+	[]byte("<?php"),
+	[]byte("<!doctype html"),
+	[]byte("<html"),
+	[]byte("<iframe"),
+	[]byte("<object"),
+	[]byte("<embed"),
+	[]byte("javascript:"),
+}
+
+var (
+	zipLocalHeader = []byte("PK\x03\x04")
+	zipEndRecord   = []byte("PK\x05\x06")
+)
+
+// zip readers look for the end of central directory record in the last
+// 22 bytes plus up to 64KiB of comment
+const zipEndSearchSize = 22 + 65535
+
+func (t *Tools) CheckPolyglot(r io.Reader) (bool, error) {
+	longest := len(zipLocalHeader)
+	for _, m := range polyglotMarkers {
+		longest = max(longest, len(m))
+	}
+	keep := longest - 1
+
+	// keep the tail of the previous chunk so markers split across reads
+	// are still found
+	buf := make([]byte, 32*1024)
+	window := make([]byte, 0, len(buf)+longest)
+	var tail []byte
+	sawLocalHeader := false
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			// the zip signatures are binary and matched exactly; only the
+			// markup markers are case-insensitive
+			window = append(window, buf[:n]...)
+			if !sawLocalHeader && bytes.Contains(window, zipLocalHeader) {
+				sawLocalHeader = true
+			}
+
+			lower := bytes.ToLower(window)
+			for _, m := range polyglotMarkers {
+				if bytes.Contains(lower, m) {
+					return true, nil
+				}
+			}
+
+			if len(window) > keep {
+				window = append(window[:0], window[len(window)-keep:]...)
+			}
+
+			tail = append(tail, buf[:n]...)
+			if len(tail) > zipEndSearchSize {
+				tail = append(tail[:0], tail[len(tail)-zipEndSearchSize:]...)
+			}
+		}
+
+		if err == io.EOF {
+			// compressed image data contains any four byte sequence now
+			// and then, so a zip only counts when it could actually be
+			// opened: a local header and an end record near the end
+			return sawLocalHeader && bytes.Contains(tail, zipEndRecord), nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+const (
+	svgNamespace   = "http://www.w3.org/2000/svg"
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+	xmlNamespace   = "http://www.w3.org/XML/1998/namespace"
+)
+
+// svgElements are the SVG elements kept by SanitizeSVG. Anything else,
+// including elements from other namespaces, is dropped with its content.
+var svgElements = makeSet(
+	"svg", "g", "defs", "desc", "title", "metadata", "symbol", "use", "image", "switch", "style", "view",
+	"path", "rect", "circle", "ellipse", "line", "polyline", "polygon",
+	"text", "tspan", "textPath", "a",
+	"marker", "pattern", "clipPath", "mask", "linearGradient", "radialGradient", "stop",
+	"filter", "feBlend", "feColorMatrix", "feComponentTransfer", "feComposite", "feConvolveMatrix",
+	"feDiffuseLighting", "feDisplacementMap", "feDistantLight", "feDropShadow", "feFlood",
+	"feFuncA", "feFuncB", "feFuncG", "feFuncR", "feGaussianBlur", "feImage", "feMerge",
+	"feMergeNode", "feMorphology", "feOffset", "fePointLight", "feSpecularLighting",
+	"feSpotLight", "feTile", "feTurbulence",
+)
+
+// svgAttributes are the unprefixed attributes kept by SanitizeSVG, on
+// top of xlink:href, xml:space and xml:lang.
+var svgAttributes = makeSet(
+	"id", "class", "style", "lang", "tabindex", "role", "aria-label", "version", "baseProfile",
+	"x", "y", "x1", "y1", "x2", "y2", "cx", "cy", "r", "rx", "ry", "fx", "fy", "fr", "z",
+	"width", "height", "d", "points", "pathLength", "viewBox", "preserveAspectRatio", "transform",
+	"fill", "fill-opacity", "fill-rule", "stroke", "stroke-width", "stroke-opacity",
+	"stroke-linecap", "stroke-linejoin", "stroke-miterlimit", "stroke-dasharray", "stroke-dashoffset",
+	"opacity", "color", "display", "visibility", "overflow", "clip-path", "clip-rule", "clipPathUnits",
+	"mask", "maskUnits", "maskContentUnits", "filter", "filterUnits", "primitiveUnits",
+	"marker-start", "marker-mid", "marker-end", "markerWidth", "markerHeight", "markerUnits",
+	"refX", "refY", "orient", "gradientUnits", "gradientTransform", "spreadMethod", "offset",
+	"stop-color", "stop-opacity", "patternUnits", "patternContentUnits", "patternTransform",
+	"font-family", "font-size", "font-style", "font-weight", "font-variant", "font-stretch",
+	"text-anchor", "dominant-baseline", "alignment-baseline", "baseline-shift", "letter-spacing",
+	"word-spacing", "text-decoration", "writing-mode", "dx", "dy", "rotate", "textLength",
+	"lengthAdjust", "startOffset", "method", "spacing", "side", "href",
+	"in", "in2", "result", "stdDeviation", "mode", "operator", "k1", "k2", "k3", "k4", "type",
+	"values", "tableValues", "slope", "intercept", "amplitude", "exponent", "baseFrequency",
+	"numOctaves", "seed", "stitchTiles", "scale", "xChannelSelector", "yChannelSelector", "radius",
+	"flood-color", "flood-opacity", "lighting-color", "surfaceScale", "diffuseConstant",
+	"specularConstant", "specularExponent", "kernelMatrix", "kernelUnitLength", "order", "divisor",
+	"bias", "targetX", "targetY", "edgeMode", "preserveAlpha", "azimuth", "elevation",
+	"pointsAtX", "pointsAtY", "pointsAtZ", "limitingConeAngle",
+	"color-interpolation", "color-interpolation-filters", "shape-rendering", "text-rendering",
+	"image-rendering", "vector-effect", "paint-order", "mix-blend-mode", "isolation",
+	"requiredExtensions", "systemLanguage",
+)
+
+func makeSet(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// SanitizeSVG re-serializes an SVG document keeping only allowlisted SVG
+// elements and attributes. Everything is written back in the default SVG
+// namespace, so prefixes from the input do not survive.
+func (t *Tools) SanitizeSVG(r io.Reader) ([]byte, error) {
+	dec := xml.NewDecoder(r)
+	dec.Strict = true
+
+	var out bytes.Buffer
+	depth := 0
+	sawRoot := false
+	skipDepth := 0
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid SVG: %w", err)
+		}
+
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+
+		if skipDepth > 0 {
+			switch tok.(type) {
+			case xml.StartElement:
+				skipDepth++
+			case xml.EndElement:
+				skipDepth--
+			}
+			continue
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			isSVGElement := (tok.Name.Space == svgNamespace || tok.Name.Space == "") && svgElements[tok.Name.Local]
+
+			if depth == 1 {
+				if sawRoot || !isSVGElement || tok.Name.Local != "svg" {
+					return nil, errors.New("file is not an SVG image")
+				}
+				sawRoot = true
+			}
+
+			if !isSVGElement {
+				skipDepth = 1
+				continue
+			}
+
+			out.WriteString("<" + tok.Name.Local)
+			if depth == 1 {
+				out.WriteString(` xmlns="` + svgNamespace + `" xmlns:xlink="` + xlinkNamespace + `"`)
+			}
+			for _, attr := range tok.Attr {
+				name, ok := svgAttributeName(attr)
+				if !ok || isUnsafeSVGURL(name, attr.Value) {
+					continue
+				}
+				out.WriteString(" " + name + `="`)
+				xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			out.WriteString("</" + tok.Name.Local + ">")
+		case xml.CharData:
+			xml.EscapeText(&out, tok)
+		case xml.Comment:
+			out.WriteString("<!--" + string(tok) + "-->")
+		case xml.ProcInst:
+			// only the XML declaration; stylesheet instructions can load
+			// XSLT or CSS from anywhere
+			if tok.Target == "xml" {
+				out.WriteString("<?xml " + string(tok.Inst) + "?>")
+			}
+		case xml.Directive:
+			// DOCTYPEs can declare entities; SVG has no use for them
+		}
+	}
+
+	if !sawRoot {
+		return nil, errors.New("file is not an SVG image")
+	}
+
+	return out.Bytes(), nil
+}
+
+// svgAttributeName returns the name attr is written back under, and
+// false when it is not allowed.
+func svgAttributeName(attr xml.Attr) (string, bool) {
+	switch attr.Name.Space {
+	case "":
+		return attr.Name.Local, svgAttributes[attr.Name.Local]
+	case xlinkNamespace:
+		return "xlink:href", attr.Name.Local == "href"
+	case xmlNamespace:
+		return "xml:" + attr.Name.Local, attr.Name.Local == "space" || attr.Name.Local == "lang"
+	default:
+		return "", false
+	}
+}
+
+func isUnsafeSVGURL(name, value string) bool {
+	if name != "href" && name != "xlink:href" && name != "values" {
+		return false
+	}
+
+	// browsers ignore whitespace and control characters in the scheme
+	value = strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, value))
+
+	if strings.Contains(value, "javascript:") {
+		return true
+	}
+
+	return name != "values" && strings.HasPrefix(value, "data:")
+}
+
+func isSVG(buf []byte, fileType, filename string) bool {
+	if strings.EqualFold(filepath.Ext(filename), ".svg") {
+		return true
+	}
+
+	// sniffing reports SVG as XML or plain text
+	return (strings.HasPrefix(fileType, "text/xml") || strings.HasPrefix(fileType, "text/plain")) &&
+		bytes.Contains(bytes.ToLower(buf), []byte("<svg"))
+}
+
+func (t *Tools) ValidateCSV(r io.Reader, requiredHeaders []string, maxRows int) (int, error) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return 0, errors.New("CSV file is empty")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid CSV: %w", err)
+	}
+
+	columns := make([]string, len(header))
+	for i, h := range header {
+		columns[i] = strings.TrimSpace(h)
+	}
+	columns[0] = strings.TrimPrefix(columns[0], string(utf8BOM))
+
+	var missing []string
+	for _, required := range requiredHeaders {
+		if !slices.ContainsFunc(columns, func(c string) bool { return strings.EqualFold(c, required) }) {
+			missing = append(missing, required)
+		}
+	}
+
+	if len(missing) > 0 {
+		return 0, fmt.Errorf("CSV file is missing required columns: %s", strings.Join(missing, ", "))
+	}
+
+	rows := 0
+	for {
+		_, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rows, fmt.Errorf("invalid CSV: %w", err)
+		}
+
+		rows++
+		if maxRows > 0 && rows > maxRows {
+			return rows, fmt.Errorf("CSV file must not have more than %d rows", maxRows)
+		}
+	}
+
+	return rows, nil
+}
+
+func (t *Tools) MatchMagicBytes(head []byte, signatures [][]byte) bool {
+	for _, sig := range signatures {
+		if len(sig) > 0 && bytes.HasPrefix(head, sig) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *Tools) isAllowedFileType(fileType, field string) bool {
+	allowedTypes, ok := t.FieldFileTypes[field]
+	if !ok {
+		allowedTypes = t.AllowedFileTypes
+	}
+
+	if len(allowedTypes) == 0 {
+		return true
+	}
+
+	for _, allowed := range allowedTypes {
+		if strings.EqualFold(fileType, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *Tools) EchoUpload(w http.ResponseWriter, r *http.Request) error {
+	maxSize := t.MaxFileSize
+	if maxSize == 0 {
+		maxSize = defaultMaxFileSize
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxSize))
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return errors.New("no file uploaded")
+		}
+		if err != nil {
+			return err
+		}
+
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		defer part.Close()
+
+		buf := make([]byte, 512)
+		n, err := io.ReadFull(part, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		buf = buf[:n]
+
+		fileType := http.DetectContentType(buf)
+		if !t.isAllowedFileType(fileType, part.FormName()) {
+			return errors.New("uploaded file type is not permitted")
+		}
+
+		// the upload comes from the client, possibly via a cross-site
+		// form, so never let the browser run it in this origin
+		w.Header().Set("Content-Type", fileType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		if isActiveContent(fileType) {
+			w.Header().Set("Content-Disposition", t.attachmentDisposition(filepath.Base(part.FileName())))
+		}
+		w.WriteHeader(http.StatusOK)
+
+		_, err = io.Copy(w, io.MultiReader(bytes.NewReader(buf), part))
+		return err
+	}
+}
+
+// isActiveContent reports whether browsers render fileType as a document
+// that can run script.
+func isActiveContent(fileType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(fileType)
+	return mediaType == "text/html" || mediaType == "text/xml" || mediaType == "application/xml"
+}
+
+func truncateFileName(name string, maxLen int) string {
+	if len(name) <= maxLen {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) >= maxLen {
+		return truncateUTF8(name, maxLen)
+	}
+
+	return truncateUTF8(strings.TrimSuffix(name, ext), maxLen-len(ext)) + ext
+}
+
+func truncateUTF8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+
+	if maxBytes <= 0 {
+		return ""
+	}
+
+	for maxBytes > 0 && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+
+	return s[:maxBytes]
+}
+
+func (t *Tools) BuildMultipartRequest(uri string, files map[string]io.Reader, fields map[string]string) (*http.Request, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		if err := writer.WriteField(name, fields[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		fileName := name
+		if f, ok := files[name].(interface{ Name() string }); ok {
+			fileName = filepath.Base(f.Name())
+		}
+
+		part, err := writer.CreateFormFile(name, fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := io.Copy(part, files[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest("POST", uri, body)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return request, nil
+}
+
+func (t *Tools) CreateDirIfNotExists(path string) error {
+	const mode = 0755
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err := os.MkdirAll(path, mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tools) DirSize(path string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+type SlugOptions struct {
+	StopWords []string
+}
+
+func (t *Tools) Slugify(s string) (string, error) {
+	return t.SlugifyWithOptions(s, SlugOptions{})
+}
+
+func (t *Tools) SlugifyWithOptions(s string, opts SlugOptions) (string, error) {
+	if len(s) == 0 {
+		return "", errors.New("string should not be empty")
+	}
+
+	return t.slugify(strings.ToLower(s), opts)
+}
+
+func (t *Tools) SlugifyLocale(s, lang string) (string, error) {
+	if lang == "" {
+		return t.Slugify(s)
+	}
+
+	if len(s) == 0 {
+		return "", errors.New("string should not be empty")
+	}
+
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return "", fmt.Errorf("invalid language %q: %w", lang, err)
+	}
+
+	// lowercase with the language's rules, then fold accented letters to
+	// their ASCII base so they survive the slug character filter
+	fold := transform.Chain(
+		cases.Lower(tag),
+		norm.NFD,
+		runes.Remove(runes.In(unicode.Mn)),
+		runes.Map(func(r rune) rune {
+			if r == 'ı' {
+				return 'i'
+			}
+			return r
+		}),
+	)
+
+	lowered, _, err := transform.String(fold, s)
+	if err != nil {
+		return "", err
+	}
+
+	return t.slugify(lowered, SlugOptions{})
+}
+
+func (t *Tools) slugify(lowered string, opts SlugOptions) (string, error) {
+	tokens := strings.FieldsFunc(slugRe.ReplaceAllString(lowered, "-"), func(r rune) bool {
+		return r == '-'
+	})
+
+	if len(opts.StopWords) > 0 {
+		var kept []string
+		for _, token := range tokens {
+			if !slices.ContainsFunc(opts.StopWords, func(w string) bool { return strings.EqualFold(w, token) }) {
+				kept = append(kept, token)
+			}
+		}
+
+		// a string made only of stop words keeps them rather than producing an empty slug
+		if len(kept) > 0 {
+			tokens = kept
+		}
+	}
+
+	slug := strings.Join(tokens, "-")
+
+	if len(slug) == 0 {
+		return "", errors.New("given string produces empty slug")
+	}
+
+	return slug, nil
+}
+
+func (t *Tools) SafeJoin(base, userPath string) (string, error) {
+	if !filepath.IsLocal(userPath) {
+		return "", fmt.Errorf("path %q escapes the base directory", userPath)
+	}
+
+	return filepath.Join(base, userPath), nil
+}
+
+func (t *Tools) SanitizeDownloadName(name string) string {
+	var b strings.Builder
+
+	space := false
+	for _, r := range name {
+		switch {
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		case unicode.IsControl(r) || strings.ContainsRune(`"\/:;,*?<>|`, r):
+			r = '_'
+		}
+
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+
+		b.WriteRune(r)
+	}
+
+	sanitized := strings.Trim(b.String(), ". ")
+	if sanitized == "" {
+		return "download"
+	}
+
+	return sanitized
+}
+
+func (t *Tools) attachmentDisposition(displayName string) string {
+	return fmt.Sprintf("attachment; filename=\"%s\"", url.QueryEscape(t.SanitizeDownloadName(displayName)))
+}
+
+func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, path, fileName, displayName string) {
+	fp, err := t.SafeJoin(path, fileName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", t.attachmentDisposition(displayName))
+
+	http.ServeFile(w, r, fp)
+}
+
+func (t *Tools) ServeUpload(w http.ResponseWriter, r *http.Request, uploadDir, fileName string) {
+	if _, err := t.SafeJoin(uploadDir, fileName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// opening through the root also stops symlinks inside the upload
+	// directory from pointing outside it
+	f, err := os.OpenInRoot(uploadDir, fileName)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Content-Disposition", t.attachmentDisposition(filepath.Base(fileName)))
+
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+func (t *Tools) ServeStaticFileCompressed(w http.ResponseWriter, r *http.Request, path, fileName, displayName string) {
+	fp, err := t.SafeJoin(path, fileName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(fp + ".gz")
+	if err != nil || !info.Mode().IsRegular() {
+		t.DownloadStaticFile(w, r, path, fileName, displayName)
+		return
+	}
+
+	t.AddVary(w, "Accept-Encoding")
+
+	if !acceptsEncoding(r, "gzip") {
+		t.DownloadStaticFile(w, r, path, fileName, displayName)
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(fileName))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Disposition", t.attachmentDisposition(displayName))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Encoding", "gzip")
+
+	http.ServeFile(w, r, fp+".gz")
+}
+
+func (t *Tools) ServeZip(w http.ResponseWriter, displayName string, files map[string]string) error {
+	names := slices.Sorted(maps.Keys(files))
+
+	// check every source before the headers go out, since nothing can be
+	// reported to the client once the archive has started streaming
+	included := names[:0:0]
+	for _, name := range names {
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return fmt.Errorf("archive name %q is not a relative path", name)
+		}
+
+		info, err := os.Stat(files[name])
+		if err == nil && info.Mode().IsRegular() {
+			included = append(included, name)
+			continue
+		}
+
+		if !t.ZipSkipMissing {
+			return fmt.Errorf("cannot add %s to archive: file not found", name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", t.attachmentDisposition(displayName))
+	w.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(w)
+
+	for _, name := range included {
+		if err := addZipEntry(zw, name, files[name]); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func addZipEntry(zw *zip.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	header.Method = zip.Deflate
+
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, f)
+	return err
+}
+
+func (t *Tools) ServeThrottled(w http.ResponseWriter, r *http.Request, path string, bytesPerSec int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	var content io.ReadSeeker = f
+	if bytesPerSec > 0 {
+		content = &throttledReader{ctx: r.Context(), rs: f, rate: bytesPerSec}
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+}
+
+type progressReader struct {
+	r          io.Reader
+	read       int64
+	total      int64
+	onProgress func(read, total int64)
+}
+
+func (t *Tools) NewProgressReader(r io.Reader, total int64, onProgress func(read, total int64)) io.Reader {
+	if onProgress == nil {
+		return r
+	}
+
+	return &progressReader{r: r, total: total, onProgress: onProgress}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.read += int64(n)
+		pr.onProgress(pr.read, pr.total)
+	}
+
+	return n, err
+}
+
+// throttledReader paces reads so the bytes read never get ahead of rate
+// bytes per second, measured from the first read
+type throttledReader struct {
+	ctx   context.Context
+	rs    io.ReadSeeker
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if tr.start.IsZero() {
+		tr.start = time.Now()
+	}
+
+	// small reads keep the output smooth instead of bursting and stalling
+	p = p[:min(int64(len(p)), max(tr.rate/10, 1))]
+
+	n, err := tr.rs.Read(p)
+	tr.sent += int64(n)
+
+	due := tr.start.Add(time.Duration(float64(tr.sent) / float64(tr.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-tr.ctx.Done():
+			return n, tr.ctx.Err()
+		}
+	}
+
+	return n, err
+}
+
+func (tr *throttledReader) Seek(offset int64, whence int) (int64, error) {
+	return tr.rs.Seek(offset, whence)
+}
+
+var compressibleTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/wasm",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		slices.Contains(compressibleTypes, mediaType)
+}
+
+func (t *Tools) ServeStaticFileGzip(w http.ResponseWriter, r *http.Request, path, fileName, displayName string) {
+	fp, err := t.SafeJoin(path, fileName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(fileName))
+	if !isCompressible(contentType) {
+		t.DownloadStaticFile(w, r, path, fileName, displayName)
+		return
+	}
+
+	t.AddVary(w, "Accept-Encoding")
+
+	// ranges refer to the uncompressed bytes, so leave those to ServeFile
+	if !acceptsEncoding(r, "gzip") || r.Header.Get("Range") != "" {
+		t.DownloadStaticFile(w, r, path, fileName, displayName)
+		return
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", t.attachmentDisposition(displayName))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	pool := &t.runtimeState().gzipPool
+
+	gz, ok := pool.Get().(*gzip.Writer)
+	if !ok {
+		gz = gzip.NewWriter(w)
+	} else {
+		gz.Reset(w)
+	}
+	defer pool.Put(gz)
+
+	if _, err := io.Copy(gz, f); err != nil {
+		return
+	}
+
+	gz.Close()
+}
+
+func (t *Tools) AddVary(w http.ResponseWriter, headers ...string) {
+	var existing []string
+	for _, value := range w.Header().Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				existing = append(existing, field)
+			}
+		}
+	}
+
+	// Vary: * already covers every header
+	if slices.Contains(existing, "*") {
+		return
+	}
+
+	vary := existing
+	changed := false
+	for _, header := range headers {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+
+		if header == "*" {
+			vary, changed = []string{"*"}, true
+			break
+		}
+
+		header = textproto.CanonicalMIMEHeaderKey(header)
+		if !slices.ContainsFunc(vary, func(v string) bool { return strings.EqualFold(v, header) }) {
+			vary, changed = append(vary, header), true
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	w.Header().Set("Vary", strings.Join(vary, ", "))
+}
+
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, entry := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), encoding) {
+			continue
+		}
+
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(value, 64)
+			return err == nil && q > 0
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func (t *Tools) StreamDownloadSeeker(w http.ResponseWriter, r *http.Request, rs io.ReadSeeker, size int64, displayName string) error {
+	contentType := mime.TypeByExtension(filepath.Ext(displayName))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Disposition", t.attachmentDisposition(displayName))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	start, length, err := parseByteRange(r.Header.Get("Range"), size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+
+	status := http.StatusOK
+	if length != size {
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	}
+
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	_, err = io.CopyN(w, rs, length)
+	return err
+}
+
+// parseByteRange supports a single byte range. Anything it doesn't
+// understand, including multiple ranges, falls back to the full content.
+func parseByteRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, nil
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size, nil
+	}
+
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, size, nil
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, errors.New("requested range not satisfiable")
+		}
+
+		suffix = min(suffix, size)
+		return size - suffix, suffix, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, nil
+	}
+
+	if start >= size {
+		return 0, 0, errors.New("requested range not satisfiable")
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, size, nil
+		}
+		end = min(end, size-1)
+	}
+
+	return start, end - start + 1, nil
+}
+
+type JSONResponse struct {
+	Error     bool   `json:"error"`
+	Message   string `json:"message"`
+	Data      any    `json:"data,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Stack     string `json:"stack,omitempty"`
+}
+
+func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data any) error {
+	defer t.observe("read_json", time.Now())
+
+	maxBytes, err := t.limitJSONBody(w, r)
+	if err != nil {
+		return err
+	}
+
+	body, err := utf8Body(r)
+	if err != nil {
+		return err
+	}
+
+	return t.decodeJSON(body, data, maxBytes)
+}
+
+// utf8Body transcodes the request body to UTF-8 when the Content-Type
+// declares another charset.
+func utf8Body(r *http.Request) (io.Reader, error) {
+	return utf8Reader(r.Header.Get("Content-Type"), r.Body)
+}
+
+func utf8Reader(contentType string, body io.Reader) (io.Reader, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return body, nil
+	}
+
+	charset := strings.TrimSpace(params["charset"])
+	if charset == "" || strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "utf8") {
+		return body, nil
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("%w: charset %q", ErrUnsupportedMediaType, charset)
+	}
+
+	return transform.NewReader(body, enc.NewDecoder()), nil
+}
+
+// readUTF8Body reads the whole request body, transcoded to UTF-8.
+func (t *Tools) readUTF8Body(r *http.Request, maxBytes int) ([]byte, error) {
+	body, err := utf8Body(r)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, t.requestError(decodeJSONError(err, maxBytes))
+	}
+
+	return raw, nil
+}
+
+func (t *Tools) MustReadJSON(w http.ResponseWriter, r *http.Request, data any) bool {
+	err := t.ReadJSON(w, r, data)
+	if err == nil {
+		return true
+	}
+
+	status := http.StatusBadRequest
+	if errors.Is(err, ErrBodyTooLarge) {
+		status = http.StatusRequestEntityTooLarge
+	}
+
+	t.ErrorJSON(w, err, status)
+
+	return false
+}
+
+// ReadJSONVersionHeader carries the request schema version for
+// ReadVersionedJSON. A _version field in the body is used when it is absent.
+const ReadJSONVersionHeader = "X-API-Version"
+
+func (t *Tools) ReadVersionedJSON(w http.ResponseWriter, r *http.Request, versions map[string]func() any) (any, string, error) {
+	defer t.observe("read_json", time.Now())
+
+	maxBytes, err := t.limitJSONBody(w, r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	raw, err := t.readUTF8Body(r, maxBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	raw = bytes.TrimPrefix(raw, utf8BOM)
+
+	version := r.Header.Get(ReadJSONVersionHeader)
+
+	// the discriminator is not part of any schema, so take it out of the
+	// body before the strict decode
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(raw, &fields) == nil {
+		if v, ok := fields["_version"]; ok {
+			var bodyVersion string
+			if err := json.Unmarshal(v, &bodyVersion); err != nil {
+				return nil, "", t.requestError(errors.New("_version must be a string"))
+			}
+			version = cmp.Or(version, bodyVersion)
+
+			delete(fields, "_version")
+			if raw, err = json.Marshal(fields); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	factory, ok := versions[version]
+	if !ok {
+		if version == "" {
+			return nil, "", t.requestError(errors.New("request schema version is missing"))
+		}
+		return nil, "", t.requestError(fmt.Errorf("unsupported request schema version %q", version))
+	}
+
+	data := factory()
+	if err := t.decodeJSON(bytes.NewReader(raw), data, maxBytes); err != nil {
+		return nil, "", err
+	}
+
+	return data, version, nil
+}
+
+func (t *Tools) ReadJSONWithRaw(w http.ResponseWriter, r *http.Request, data any) ([]byte, error) {
+	defer t.observe("read_json", time.Now())
+
+	maxBytes, err := t.limitJSONBody(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, t.requestError(decodeJSONError(err, maxBytes))
+	}
+
+	// raw stays as sent, since callers verify signatures over it
+	body, err := utf8Reader(r.Header.Get("Content-Type"), bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.decodeJSON(body, data, maxBytes); err != nil {
+		return nil, err
+	}
+
+	return raw, nil
+}
+
+func (t *Tools) DecodeBase64JSON(encoded string, data any) error {
+	maxBytes := t.MaxJSONSize
+	if maxBytes == 0 {
+		maxBytes = 1024 * 1024
+	}
+
+	// padding is optional in practice, so drop it and decode raw
+	encoded = strings.TrimRight(strings.TrimSpace(encoded), "=")
+
+	enc := base64.RawStdEncoding
+	if strings.ContainsAny(encoded, "-_") {
+		enc = base64.RawURLEncoding
+	}
+
+	if enc.DecodedLen(len(encoded)) > maxBytes {
+		return t.requestError(bodyTooLarge(maxBytes))
+	}
+
+	decoded, err := enc.DecodeString(encoded)
+	if err != nil {
+		return t.requestError(errors.New("body is not valid base64"))
+	}
+
+	return t.decodeJSON(bytes.NewReader(decoded), data, maxBytes)
+}
+
+func (t *Tools) limitJSONBody(w http.ResponseWriter, r *http.Request) (int, error) {
+	maxBytes := t.MaxJSONSize
+	if maxBytes == 0 {
+		maxBytes = 1024 * 1024
+	}
+
+	if r.ContentLength > int64(maxBytes) {
+		return 0, t.requestError(bodyTooLarge(maxBytes))
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	return maxBytes, nil
+}
+
+func (t *Tools) decodeJSON(body io.Reader, data any, maxBytes int) error {
+	if err := t.decodeJSONValue(body, data, maxBytes); err != nil {
+		return err
+	}
+
+	return checkRanges(data)
+}
+
+func (t *Tools) decodeJSONValue(body io.Reader, data any, maxBytes int) error {
+	dec := json.NewDecoder(skipBOM(body))
+
+	if !t.JSONAllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	if t.JSONUseNumber {
+		dec.UseNumber()
+	}
+
+	err := dec.Decode(data)
+	if err != nil {
+		return t.requestError(decodeJSONError(err, maxBytes))
+	}
+
+	err = dec.Decode(&struct{}{})
+	if err != io.EOF {
+		return t.requestError(errors.New("body must contain exactly one JSON object"))
+	}
+
+	return nil
+}
+
+// skipBOM drops a leading UTF-8 byte order mark, which encoding/json
+// rejects as invalid.
+func skipBOM(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if prefix, err := br.Peek(len(utf8BOM)); err == nil && bytes.Equal(prefix, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+
+	return br
+}
+
+func checkRanges(data any) error {
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+
+	return checkStructRanges(v.Elem())
+}
+
+func checkStructRanges(v reflect.Value) error {
+	typ := v.Type()
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		value := v.Field(i)
+		if value.Kind() == reflect.Pointer {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+
+		if value.Kind() == reflect.Struct {
+			if err := checkStructRanges(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := field.Name
+		if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); tag != "" && tag != "-" {
+			name = tag
+		}
+
+		// min and max only mean something for numbers; other tools use the
+		// same tags on strings and slices, so those are left alone
+		var n float64
+		switch value.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = float64(value.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n = float64(value.Uint())
+		case reflect.Float32, reflect.Float64:
+			n = value.Float()
+		default:
+			continue
+		}
+
+		for _, bound := range []string{"min", "max"} {
+			limit, ok := field.Tag.Lookup(bound)
+			if !ok {
+				continue
+			}
+
+			l, err := strconv.ParseFloat(limit, 64)
+			if err != nil {
+				continue
+			}
+
+			if bound == "min" && n < l {
+				return fmt.Errorf("field %s must be at least %s", name, limit)
+			}
+			if bound == "max" && n > l {
+				return fmt.Errorf("field %s must be at most %s", name, limit)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadJSONWithDefaults reads JSON like ReadJSON and then applies `default`
+// struct tags. An omitted field cannot be told apart from one explicitly
+// set to its zero value, so defaults are applied to every zero field.
+func (t *Tools) ReadJSONWithDefaults(w http.ResponseWriter, r *http.Request, data any) error {
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return errors.New("destination must be a pointer to a struct")
+	}
+
+	defer t.observe("read_json", time.Now())
+
+	maxBytes, err := t.limitJSONBody(w, r)
+	if err != nil {
+		return err
+	}
+
+	body, err := utf8Body(r)
+	if err != nil {
+		return err
+	}
+
+	// ranges are checked once the defaults are in place
+	if err := t.decodeJSONValue(body, data, maxBytes); err != nil {
+		return err
+	}
+
+	if err := applyDefaults(v.Elem()); err != nil {
+		return err
+	}
+
+	return checkStructRanges(v.Elem())
+}
+
+func applyDefaults(v reflect.Value) error {
+	typ := v.Type()
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		value := v.Field(i)
+
+		if value.Kind() == reflect.Struct {
+			if err := applyDefaults(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		def, ok := field.Tag.Lookup("default")
+		if !ok || !value.IsZero() {
+			continue
+		}
+
+		params := []string{def}
+		if value.Kind() == reflect.Slice {
+			params = strings.Split(def, ",")
+		}
+
+		if err := setFieldFromStrings(value, params); err != nil {
+			return fmt.Errorf("default for field %s: %w", field.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *Tools) ReadJSONWithAllowedKeys(w http.ResponseWriter, r *http.Request, allowed []string) (map[string]any, error) {
+	var data map[string]any
+
+	if err := t.ReadJSON(w, r, &data); err != nil {
+		return nil, err
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(data)) {
+		if !slices.Contains(allowed, key) {
+			return nil, t.requestError(fmt.Errorf("body contains unknown key %q", key))
+		}
+	}
+
+	return data, nil
+}
+
+func (t *Tools) ReadJSONC(w http.ResponseWriter, r *http.Request, data any) error {
+	defer t.observe("read_json", time.Now())
+
+	maxBytes, err := t.limitJSONBody(w, r)
+	if err != nil {
+		return err
+	}
+
+	raw, err := t.readUTF8Body(r, maxBytes)
+	if err != nil {
+		return err
+	}
+
+	cleaned, err := stripJSONC(raw)
+	if err != nil {
+		return t.requestError(err)
+	}
+
+	return t.decodeJSON(bytes.NewReader(cleaned), data, maxBytes)
+}
+
+// stripJSONC blanks out comments and trailing commas with spaces, leaving
+// every other byte in place so decode errors still report useful offsets
+func stripJSONC(src []byte) ([]byte, error) {
+	out := bytes.Clone(src)
+
+	inString := false
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+
+		if inString {
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			end := bytes.Index(out[i+2:], []byte("*/"))
+			if end < 0 {
+				return nil, errors.New("body contains an unterminated comment")
+			}
+
+			for j := i; j < i+2+end+2; j++ {
+				if out[j] != '\n' {
+					out[j] = ' '
+				}
+			}
+			i += 2 + end + 1
+		}
+	}
+
+	inString = false
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+
+		if inString {
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case ',':
+			j := i + 1
+			for j < len(out) && strings.IndexByte(" \t\r\n", out[j]) >= 0 {
+				j++
+			}
+
+			if j < len(out) && (out[j] == '}' || out[j] == ']') {
+				out[i] = ' '
+			}
+		}
+	}
+
+	return out, nil
+}
+
+type ItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("item %d: %s", e.Index, e.Err)
+}
+
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+// ReadJSONArray decodes a JSON array one element at a time, so a bad element
+// is reported as an *ItemError and the valid ones are still returned. Errors
+// that make the array itself unreadable are returned without an index.
+func (t *Tools) ReadJSONArray(w http.ResponseWriter, r *http.Request, elem func() any) ([]any, []error) {
+	defer t.observe("read_json", time.Now())
+
+	maxBytes, err := t.limitJSONBody(w, r)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	body, err := utf8Body(r)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	dec := json.NewDecoder(skipBOM(body))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, []error{t.requestError(decodeJSONError(err, maxBytes))}
+	}
+
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, []error{t.requestError(errors.New("body must be a JSON array"))}
+	}
+
+	var results []any
+	var errs []error
+
+	for index := 0; dec.More(); index++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return results, append(errs, t.requestError(decodeJSONError(err, maxBytes)))
+		}
+
+		item := elem()
+		if err := t.decodeJSON(bytes.NewReader(raw), item, maxBytes); err != nil {
+			errs = append(errs, &ItemError{Index: index, Err: err})
+			continue
+		}
+
+		results = append(results, item)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return results, append(errs, t.requestError(decodeJSONError(err, maxBytes)))
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return results, append(errs, t.requestError(errors.New("body must contain exactly one JSON array")))
+	}
+
+	return results, errs
+}
+
+var errElementTooLarge = errors.New("array element too large")
+
+func (t *Tools) StreamJSONArray(r io.Reader, out chan<- json.RawMessage) error {
+	defer close(out)
+
+	maxBytes := t.MaxJSONSize
+	if maxBytes == 0 {
+		maxBytes = 1024 * 1024
+	}
+
+	lr := &elementLimitReader{r: r}
+	dec := json.NewDecoder(lr)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return t.requestError(decodeJSONError(err, maxBytes))
+	}
+
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return t.requestError(errors.New("body must be a JSON array"))
+	}
+
+	for index := 0; dec.More(); index++ {
+		start := dec.InputOffset()
+		// the decoder reads ahead, so allow some slack past the element
+		// limit before cutting the underlying reader off
+		lr.limit = start + int64(maxBytes) + 4096
+
+		var element json.RawMessage
+		if err := dec.Decode(&element); err != nil {
+			if errors.Is(err, errElementTooLarge) {
+				return t.requestError(&tooLargeError{fmt.Sprintf("array element %d must not be larger than %d bytes", index, maxBytes)})
+			}
+			return t.requestError(fmt.Errorf("array element %d: %w", index, decodeJSONError(err, maxBytes)))
+		}
+
+		if dec.InputOffset()-start > int64(maxBytes) {
+			return t.requestError(&tooLargeError{fmt.Sprintf("array element %d must not be larger than %d bytes", index, maxBytes)})
+		}
+
+		out <- element
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return t.requestError(decodeJSONError(err, maxBytes))
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return t.requestError(errors.New("body must contain exactly one JSON array"))
+	}
+
+	return nil
+}
+
+type elementLimitReader struct {
+	r     io.Reader
+	read  int64
+	limit int64
+}
+
+func (lr *elementLimitReader) Read(p []byte) (int, error) {
+	if lr.limit > 0 {
+		if lr.read >= lr.limit {
+			return 0, errElementTooLarge
+		}
+		p = p[:min(int64(len(p)), lr.limit-lr.read)]
+	}
+
+	n, err := lr.r.Read(p)
+	lr.read += int64(n)
+
+	return n, err
+}
+
+func decodeJSONError(err error, maxBytes int) error {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var invalidUnmarshalError *json.InvalidUnmarshalError
+
+	switch {
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("body contains badly formed JSON at character %d", syntaxError.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("body contains badly formed JSON")
+	case errors.As(err, &unmarshalTypeError):
+		if unmarshalTypeError.Field != "" {
+			return fmt.Errorf("body contains incorrect JSON type for field %v", unmarshalTypeError.Field)
+		}
+		return fmt.Errorf("body contains incorrect JSON type at character %d", unmarshalTypeError.Offset)
+	case errors.Is(err, io.EOF):
+		return errors.New("body must not be empty")
+	case strings.HasPrefix(err.Error(), "json: unknown field"):
+		fieldName := strings.TrimPrefix(err.Error(), "json: unknown field")
+		return fmt.Errorf("body contains unknown key %s", fieldName)
+	case err.Error() == "http: request body too large":
+		return bodyTooLarge(maxBytes)
+	case errors.As(err, &invalidUnmarshalError):
+		return fmt.Errorf("error unmarshalling JSON: %s", err.Error())
+	default:
+		return err
+	}
+}
+
+type tooLargeError struct {
+	message string
+}
+
+func (e *tooLargeError) Error() string {
+	return e.message
+}
+
+func (e *tooLargeError) Is(target error) bool {
+	return target == ErrBodyTooLarge
+}
+
+func bodyTooLarge(maxBytes int) error {
+	return &tooLargeError{fmt.Sprintf("body must not be larger than %d bytes", maxBytes)}
+}
+
+type PublicError struct {
+	Message string
+	Err     error
+}
+
+func (e *PublicError) Error() string {
+	return e.Message
+}
+
+func (e *PublicError) Unwrap() error {
+	return e.Err
+}
+
+func (t *Tools) requestError(err error) error {
+	if t.ProductionMode {
+		return &PublicError{Message: "invalid request body", Err: err}
+	}
+
+	return err
+}
+
+func (t *Tools) ReadJSONWithTimeout(w http.ResponseWriter, r *http.Request, data any, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Now().Add(timeout)); err == nil {
+		defer rc.SetReadDeadline(time.Time{})
+	}
+
+	body := r.Body
+	stop := context.AfterFunc(ctx, func() {
+		body.Close()
+	})
+	defer stop()
+
+	r.Body = &contextReader{ctx: ctx, r: body}
+
+	err := t.ReadJSON(w, r, data)
+	if err != nil && (ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded)) {
+		return ErrReadTimeout
+	}
+
+	return err
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.ReadCloser
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.r.Read(p)
+}
+
+func (cr *contextReader) Close() error {
+	return cr.r.Close()
+}
+
+func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data any, headers ...http.Header) error {
+	return t.writeJSON(w, status, t.envelope(t.transform(data)), headers...)
+}
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func (t *Tools) WriteJSONWithID(w http.ResponseWriter, r *http.Request, status int, data any, headers ...http.Header) error {
+	// only echo IDs that are safe to put in logs and headers
+	id := r.Header.Get("X-Request-ID")
+	if !requestIDRe.MatchString(id) {
+		id = hex.EncodeToString(secureRandomBytes(16))
+	}
+
+	w.Header().Set("X-Request-ID", id)
+
+	var payload JSONResponse
+	switch v := t.transform(data).(type) {
+	case JSONResponse:
+		payload = v
+	case *JSONResponse:
+		payload = *v
+	default:
+		payload.Data = v
+	}
+	payload.RequestID = id
+
+	return t.writeJSON(w, status, t.shapeResponse(payload), headers...)
+}
+
+func (t *Tools) transform(data any) any {
+	if t.ResponseTransformer == nil {
+		return data
+	}
+
+	return t.ResponseTransformer(data)
+}
+
+func (t *Tools) envelope(data any) any {
+	switch v := data.(type) {
+	case JSONResponse:
+		return t.shapeResponse(v)
+	case *JSONResponse:
+		if v != nil {
+			return t.shapeResponse(*v)
+		}
+	}
+
+	if !t.AlwaysEnvelope {
+		return data
+	}
+
+	return t.shapeResponse(JSONResponse{Data: data})
+}
+
+func (t *Tools) shapeResponse(resp JSONResponse) any {
+	if t.EnvelopeFunc == nil {
+		return resp
+	}
+
+	return t.EnvelopeFunc(resp)
+}
+
+func (t *Tools) writeJSON(w http.ResponseWriter, status int, data any, headers ...http.Header) error {
+	defer t.observe("write_json", time.Now())
+
+	out, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if t.MaxResponseSize > 0 && len(out) > t.MaxResponseSize {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrResponseTooLarge, len(out), t.MaxResponseSize)
+	}
+
+	if len(headers) > 0 {
+		for k, v := range headers[0] {
+			w.Header()[k] = v
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_, err = w.Write(out)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *Tools) WriteJSONCanonical(w http.ResponseWriter, status int, data any, headers ...http.Header) error {
+	out, err := json.Marshal(t.envelope(t.transform(data)))
+	if err != nil {
+		return err
+	}
+
+	// maps are marshaled with sorted keys, so a round-trip through any
+	// reorders struct fields as well
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.UseNumber()
+
+	var canonical any
+	if err := dec.Decode(&canonical); err != nil {
+		return err
+	}
+
+	return t.writeJSON(w, status, canonical, headers...)
+}
+
+func (t *Tools) WriteNDJSON(w http.ResponseWriter, status int, next func() (any, bool, error)) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(status)
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	lastFlush := time.Now()
+
+	for {
+		item, ok, err := next()
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			break
+		}
+
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+
+		if time.Since(lastFlush) >= ndjsonFlushInterval {
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+			lastFlush = time.Now()
+		}
+	}
+
+	if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	return nil
+}
+
+func (t *Tools) WriteRedirect(w http.ResponseWriter, status int, location string) error {
+	switch status {
+	case http.StatusMultipleChoices, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("status %d is not a redirect status", status)
+	}
+
+	if location == "" {
+		return errors.New("redirect location should not be empty")
+	}
+
+	w.Header().Set("Location", location)
+	w.WriteHeader(status)
+
+	return nil
+}
+
+func (t *Tools) WriteRedirectJSON(w http.ResponseWriter, status int, location string) error {
+	if location == "" {
+		return errors.New("redirect location should not be empty")
+	}
+
+	payload := struct {
+		Redirect string `json:"redirect"`
+	}{Redirect: location}
+
+	return t.WriteJSON(w, status, payload)
+}
+
+func (t *Tools) WriteHealth(w http.ResponseWriter, checks map[string]error) error {
+	payload := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{Status: "ok", Checks: make(map[string]string, len(checks))}
+
+	status := http.StatusOK
+	for name, err := range checks {
+		if err != nil {
+			payload.Checks[name] = err.Error()
+			payload.Status = "degraded"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		payload.Checks[name] = "ok"
+	}
+
+	// health output has a fixed shape that monitors rely on, so it skips
+	// AlwaysEnvelope, EnvelopeFunc and the response transformer
+	w.Header().Set("Cache-Control", "no-store")
+
+	return t.writeJSON(w, status, payload)
+}
+
+func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
+	statusCode := http.StatusBadRequest
+
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	var payload = JSONResponse{
+		Error:   true,
+		Message: err.Error(),
+	}
+
+	var pe *PanicError
+	if t.Debug && !t.ProductionMode && errors.As(err, &pe) {
+		payload.Stack = string(pe.Stack)
+	}
+
+	return t.WriteJSON(w, statusCode, payload)
+}
+
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+func (t *Tools) RecoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+
+			// the server relies on this panic to abort the response quietly
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			pe := &PanicError{Value: rec, Stack: debug.Stack()}
+
+			if t.Logger != nil {
+				t.Logger.Warn("recovered from panic", "method", r.Method, "path", r.URL.Path, "panic", rec)
+			}
+
+			var err error = pe
+			if !t.Debug || t.ProductionMode {
+				err = &PublicError{Message: "internal server error", Err: pe}
+			}
+
+			t.ErrorJSON(w, err, http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (t *Tools) MethodNotAllowed(w http.ResponseWriter, allowed ...string) error {
+	methods := make([]string, 0, len(allowed))
+	for _, m := range allowed {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m != "" && !slices.Contains(methods, m) {
+			methods = append(methods, m)
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+
+	return t.ErrorJSON(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+}
+
+type fieldError interface {
+	Field() string
+	Error() string
+}
+
+// ErrorJSONFromValidation writes one message per field for errors shaped like
+// validator.ValidationErrors: a slice whose elements have Field and Error
+// methods. Any other error is written with ErrorJSON.
+func (t *Tools) ErrorJSONFromValidation(w http.ResponseWriter, err error, status ...int) error {
+	v := reflect.ValueOf(err)
+	if v.Kind() != reflect.Slice || v.Len() == 0 {
+		return t.ErrorJSON(w, err, status...)
+	}
+
+	fields := make(map[string]string, v.Len())
+	for i := range v.Len() {
+		fe, ok := v.Index(i).Interface().(fieldError)
+		if !ok {
+			return t.ErrorJSON(w, err, status...)
+		}
+
+		// keep the first message when a field fails several rules
+		if _, seen := fields[fe.Field()]; !seen {
+			fields[fe.Field()] = fe.Error()
+		}
+	}
+
+	statusCode := http.StatusBadRequest
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	// a custom envelope decides the shape itself, with the field errors
+	// passed on as Data
+	if t.EnvelopeFunc != nil {
+		return t.writeJSON(w, statusCode, t.shapeResponse(JSONResponse{Error: true, Message: "validation failed", Data: fields}))
+	}
+
+	payload := struct {
+		Error   bool              `json:"error"`
+		Message string            `json:"message"`
+		Errors  map[string]string `json:"errors"`
+	}{Error: true, Message: "validation failed", Errors: fields}
+
+	return t.writeJSON(w, statusCode, payload)
+}
+
+func (t *Tools) WriteNoContent(w http.ResponseWriter) {
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNoContent)
+}
 
 func (t *Tools) PushJSONToRemote(uri string, data any, client ...*http.Client) (*http.Response, int, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, err
+	}
+
+	return t.pushJSON(t.httpClient(client...), uri, jsonData)
+}
+
+func (t *Tools) pushJSON(httpClient *http.Client, uri string, jsonData []byte) (*http.Response, int, error) {
+	defer t.observe("push_json", time.Now())
+
+	if err := t.checkRemoteURI(uri); err != nil {
+		return nil, 0, err
+	}
+
+	request, err := http.NewRequest("POST", uri, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+
+	return response, response.StatusCode, nil
+}
+
+type pushOutcome struct {
+	response *http.Response
+	status   int
+}
+
+// PushJSONToRemoteSingleflight behaves like PushJSONToRemote, but concurrent
+// calls with the same key share a single request and its result. Callers
+// must only share a key when they push the same data to the same URI.
+func (t *Tools) PushJSONToRemoteSingleflight(key, uri string, data any, client ...*http.Client) (*http.Response, int, error) {
+	v, err, _ := t.runtimeState().pushGroup.Do(key, func() (any, error) {
+		response, status, err := t.PushJSONToRemote(uri, data, client...)
+		return pushOutcome{response: response, status: status}, err
+	})
+
+	outcome, _ := v.(pushOutcome)
+
+	return outcome.response, outcome.status, err
+}
+
+type PushResult struct {
+	URI        string
+	StatusCode int
+	Err        error
+}
+
+func (t *Tools) PushJSONToMany(uris []string, data any, concurrency int, client ...*http.Client) []PushResult {
+	results := make([]PushResult, len(uris))
+	for i, uri := range uris {
+		results[i].URI = uri
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
+
+	httpClient := t.httpClient(client...)
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	for range min(max(concurrency, 1), len(uris)) {
+		wg.Go(func() {
+			for i := range jobs {
+				_, status, err := t.pushJSON(httpClient, uris[i], jsonData)
+				results[i].StatusCode = status
+				results[i].Err = err
+			}
+		})
+	}
+
+	for i := range uris {
+		jobs <- i
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	return results
+}
+
+func (t *Tools) ClientIP(r *http.Request, trustedProxies []string) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = host
+	}
+
+	if !isTrustedProxy(peer, trustedProxies) {
+		return peer
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+
+		var leftmost string
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+
+			leftmost = addr.Unmap().String()
+			if !isTrustedProxy(leftmost, trustedProxies) {
+				return leftmost
+			}
+		}
+
+		if leftmost != "" {
+			return leftmost
+		}
+	}
+
+	if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.Unmap().String()
+	}
+
+	return peer
+}
+
+func isTrustedProxy(ip string, trustedProxies []string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, proxy := range trustedProxies {
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err == nil && prefix.Contains(addr) {
+				return true
+			}
+			continue
+		}
+
+		trusted, err := netip.ParseAddr(proxy)
+		if err == nil && trusted.Unmap() == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+func (t *Tools) ParseSort(r *http.Request, allowed []string) ([]SortField, error) {
+	param := r.URL.Query().Get("sort")
+	if param == "" {
+		return nil, nil
+	}
+
+	var fields []SortField
+
+	for _, token := range strings.Split(param, ",") {
+		token = strings.TrimSpace(token)
+
+		var field SortField
+		switch {
+		case strings.HasPrefix(token, "-"):
+			field.Desc = true
+			field.Field = token[1:]
+		case strings.HasPrefix(token, "+"):
+			field.Field = token[1:]
+		default:
+			field.Field = token
+		}
+
+		if field.Field == "" {
+			return nil, errors.New("sort contains an empty field")
+		}
+
+		if !slices.Contains(allowed, field.Field) {
+			return nil, fmt.Errorf("sorting by %q is not allowed", field.Field)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+func (t *Tools) HashPassword(pw string) (string, error) {
+	cost := t.BcryptCost
+	if cost == 0 {
+		cost = defaultBcryptCost
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pw), cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (t *Tools) CheckPassword(pw, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)) == nil
+}
+
+var commonPasswords = map[string]bool{
+	"123456": true, "123456789": true, "12345678": true, "12345": true, "1234567": true,
+	"1234567890": true, "111111": true, "000000": true, "123123": true, "654321": true,
+	"password": true, "password1": true, "password123": true, "passw0rd": true, "p@ssw0rd": true,
+	"qwerty": true, "qwerty123": true, "qwertyuiop": true, "asdfghjkl": true, "1q2w3e4r": true,
+	"abc123": true, "iloveyou": true, "admin": true, "admin123": true, "welcome": true,
+	"welcome1": true, "letmein": true, "monkey": true, "dragon": true, "football": true,
+	"baseball": true, "sunshine": true, "princess": true, "master": true, "shadow": true,
+	"superman": true, "trustno1": true, "login": true, "starwars": true, "changeme": true,
+	"secret": true, "zaq12wsx": true, "michael": true, "hello123": true, "whatever": true,
+}
+
+func (t *Tools) PasswordStrength(pw string) (int, []string) {
+	var reasons []string
+
+	length := utf8.RuneCountInString(pw)
+	if length < 8 {
+		reasons = append(reasons, "password must be at least 8 characters")
+	}
+
+	var lower, upper, digit, symbol bool
+	distinct := make(map[rune]bool)
+	for _, r := range pw {
+		distinct[r] = true
+
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	pool, classes := 0, 0
+	for _, c := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}} {
+		if c.present {
+			pool += c.size
+			classes++
+		}
+	}
+
+	if classes < 3 {
+		reasons = append(reasons, "password should mix lowercase, uppercase, digits and symbols")
+	}
+
+	if length > 0 && len(distinct) <= length/3 {
+		reasons = append(reasons, "password repeats the same characters")
+	}
+
+	if commonPasswords[strings.ToLower(pw)] {
+		return 0, append(reasons, "password is too common")
+	}
+
+	// entropy of a random string over the character classes used, counting
+	// each distinct character once so repetition does not inflate the score
+	entropy := float64(len(distinct)) * math.Log2(float64(max(pool, 1)))
+	if length < 8 {
+		entropy = min(entropy, 27)
+	}
+
+	var score int
+	switch {
+	case entropy >= 80:
+		score = 4
+	case entropy >= 60:
+		score = 3
+	case entropy >= 36:
+		score = 2
+	case entropy >= 28:
+		score = 1
+	}
+
+	return score, reasons
+}
+
+var emailDomainLabel = regexp.MustCompile(`^[a-z\d]([a-z\d-]*[a-z\d])?$`)
+
+func (t *Tools) ValidateEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", errors.New("email should not be empty")
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", fmt.Errorf("%q is not a valid email address", email)
+	}
+
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], strings.ToLower(email[at+1:])
+
+	if len(local) > 64 || len(email) > 254 {
+		return "", errors.New("email address is too long")
+	}
+
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("email domain %q is not fully qualified", domain)
+	}
+
+	for _, label := range labels {
+		if len(label) > 63 || !emailDomainLabel.MatchString(label) {
+			return "", fmt.Errorf("email domain %q is not valid", domain)
+		}
+	}
+
+	if tld := labels[len(labels)-1]; len(tld) < 2 || strings.Trim(tld, "abcdefghijklmnopqrstuvwxyz") != "" {
+		return "", fmt.Errorf("email domain %q is not valid", domain)
+	}
+
+	return local + "@" + domain, nil
+}
+
+func (t *Tools) ReadIDParam(r *http.Request, name string) (int64, error) {
+	value := r.PathValue(name)
+	if value == "" {
+		return 0, fmt.Errorf("missing path parameter %s", name)
+	}
+
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("path parameter %s must be a number", name)
+	}
+
+	if id < 0 {
+		return 0, fmt.Errorf("path parameter %s must not be negative", name)
+	}
+
+	return id, nil
+}
+
+func (t *Tools) ReadBoolParam(r *http.Request, name string, def bool) bool {
+	switch strings.ToLower(strings.TrimSpace(r.URL.Query().Get(name))) {
+	case "true", "1", "yes", "y", "on", "t":
+		return true
+	case "false", "0", "no", "n", "off", "f":
+		return false
+	default:
+		return def
+	}
+}
+
+func (t *Tools) ReadDateRange(r *http.Request, layout string) (time.Time, time.Time, error) {
+	if layout == "" {
+		layout = time.DateOnly
+	}
+
+	query := r.URL.Query()
+
+	parse := func(name string) (time.Time, error) {
+		value := query.Get(name)
+		if value == "" {
+			return time.Time{}, fmt.Errorf("missing query parameter %s", name)
+		}
+
+		date, err := time.Parse(layout, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("query parameter %s must be a date in the format %s", name, layout)
+		}
+
+		return date, nil
+	}
+
+	from, err := parse("from")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	to, err := parse("to")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if from.After(to) {
+		return time.Time{}, time.Time{}, errors.New("query parameter from must not be after to")
+	}
+
+	return from, to, nil
+}
+
+func (t *Tools) NegotiateLanguage(r *http.Request, supported []string, defaultLang string) string {
+	type langQuality struct {
+		tag string
+		q   float64
+	}
+
+	var prefs []langQuality
+
+	for _, entry := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		if q <= 0 {
+			continue
+		}
+
+		prefs = append(prefs, langQuality{tag: tag, q: q})
+	}
+
+	slices.SortStableFunc(prefs, func(a, b langQuality) int {
+		return cmp.Compare(b.q, a.q)
+	})
+
+	for _, pref := range prefs {
+		if pref.tag == "*" {
+			return defaultLang
+		}
+
+		for _, lang := range supported {
+			if strings.EqualFold(lang, pref.tag) {
+				return lang
+			}
+		}
+
+		base, _, _ := strings.Cut(pref.tag, "-")
+		for _, lang := range supported {
+			supportedBase, _, _ := strings.Cut(lang, "-")
+			if strings.EqualFold(supportedBase, base) {
+				return lang
+			}
+		}
+	}
+
+	return defaultLang
+}
+
+func (t *Tools) ReadQuery(r *http.Request, dst any) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return errors.New("destination must be a pointer to a struct")
+	}
+
+	return bindValues(v.Elem(), r.URL.Query(), "query")
+}
+
+func (t *Tools) ReadForm(w http.ResponseWriter, r *http.Request, dst any) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return errors.New("destination must be a pointer to a struct")
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var values url.Values
+	if mediaType == "multipart/form-data" {
+		if t.MaxFileSize == 0 {
+			t.MaxFileSize = defaultMaxFileSize
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, int64(t.MaxFileSize))
+		if err := r.ParseMultipartForm(int64(t.MaxFileSize)); err != nil {
+			return t.requestError(fmt.Errorf("invalid multipart form: %w", err))
+		}
+		values = r.MultipartForm.Value
+	} else {
+		maxBytes, err := t.limitJSONBody(w, r)
+		if err != nil {
+			return err
+		}
+
+		if err := r.ParseForm(); err != nil {
+			if err.Error() == "http: request body too large" {
+				return t.requestError(bodyTooLarge(maxBytes))
+			}
+			return t.requestError(fmt.Errorf("invalid form: %w", err))
+		}
+		values = r.PostForm
+	}
+
+	if err := bindValues(v.Elem(), values, "form"); err != nil {
+		return t.requestError(err)
+	}
+
+	return nil
+}
+
+func (t *Tools) ReadRequest(w http.ResponseWriter, r *http.Request, dst any) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ErrUnsupportedMediaType
+	}
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return t.ReadJSON(w, r, dst)
+	case mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data":
+		return t.ReadForm(w, r, dst)
+	default:
+		return ErrUnsupportedMediaType
+	}
+}
+
+func bindValues(v reflect.Value, values url.Values, tagName string) error {
+	typ := v.Type()
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+
+		name := field.Tag.Get(tagName)
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+
+		params, ok := values[name]
+		if !ok {
+			def, hasDefault := field.Tag.Lookup("default")
+			if !hasDefault {
+				continue
+			}
+
+			params = []string{def}
+			if field.Type.Kind() == reflect.Slice {
+				params = strings.Split(def, ",")
+			}
+		}
+
+		if err := setFieldFromStrings(v.Field(i), params); err != nil {
+			return fmt.Errorf("%s parameter %s: %w", tagName, name, err)
+		}
+	}
+
+	return nil
+}
+
+func setFieldFromStrings(field reflect.Value, values []string) error {
+	if field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.Uint8 {
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setFieldFromString(slice.Index(i), value); err != nil {
+				return err
+			}
+		}
+
+		field.Set(slice)
+		return nil
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	return setFieldFromString(field, values[0])
+}
+
+func setFieldFromString(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeFor[time.Duration]() {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid duration", value)
+		}
+
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid boolean", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a valid integer", value)
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a valid unsigned integer", value)
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a valid number", value)
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+
+	return nil
+}
+
+func (t *Tools) SetPaginationLinks(w http.ResponseWriter, baseURL string, page, perPage, total int) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+
+	if perPage <= 0 {
+		return errors.New("per page must be positive")
+	}
+
+	lastPage := max((total+perPage-1)/perPage, 1)
+	page = max(page, 1)
+
+	link := func(p int, rel string) string {
+		query := u.Query()
+		query.Set("page", strconv.Itoa(p))
+		query.Set("per_page", strconv.Itoa(perPage))
+
+		pageURL := *u
+		pageURL.RawQuery = query.Encode()
+
+		return fmt.Sprintf(`<%s>; rel="%s"`, pageURL.String(), rel)
+	}
+
+	var links []string
+
+	if page < lastPage {
+		links = append(links, link(page+1, "next"))
+	}
+
+	if page > 1 {
+		links = append(links, link(min(page-1, lastPage), "prev"))
+	}
+
+	links = append(links, link(1, "first"), link(lastPage, "last"))
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+
+	return nil
+}
+
+func (t *Tools) Paginate(items any, page, perPage int) (any, int) {
+	v := reflect.ValueOf(items)
+	if v.Kind() != reflect.Slice {
+		return nil, 0
+	}
+
+	total := v.Len()
+	offset, limit, _ := t.PageBounds(page, perPage, total)
+
+	return v.Slice(offset, offset+limit).Interface(), total
+}
+
+func (t *Tools) PageBounds(page, perPage, total int) (int, int, int) {
+	total = max(total, 0)
+	if perPage <= 0 {
+		return 0, 0, 0
 	}
 
-	httpClient := &http.Client{}
+	totalPages := total / perPage
+	if total%perPage != 0 {
+		totalPages++
+	}
+
+	// compare page numbers rather than multiplying, which could overflow
+	page = max(page, 1)
+	if page > totalPages {
+		return total, 0, totalPages
+	}
+
+	offset := (page - 1) * perPage
+
+	return offset, min(perPage, total-offset), totalPages
+}
+
+type CookieOptions struct {
+	Name              string
+	Value             string
+	Path              string
+	Domain            string
+	MaxAge            int
+	Expires           time.Time
+	SameSite          http.SameSite
+	AllowScriptAccess bool
+	Insecure          bool
+}
+
+func (t *Tools) SetCookie(w http.ResponseWriter, cookie CookieOptions) error {
+	if cookie.Name == "" {
+		return errors.New("cookie name must not be empty")
+	}
+
+	c := &http.Cookie{
+		Name:     cookie.Name,
+		Value:    cookie.Value,
+		Path:     cmp.Or(cookie.Path, "/"),
+		Domain:   cookie.Domain,
+		MaxAge:   cookie.MaxAge,
+		Expires:  cookie.Expires,
+		HttpOnly: !cookie.AllowScriptAccess,
+		Secure:   !cookie.Insecure,
+		SameSite: cmp.Or(cookie.SameSite, http.SameSiteLaxMode),
+	}
+
+	if c.SameSite == http.SameSiteNoneMode && !c.Secure {
+		return errors.New("SameSite=None cookies must be secure")
+	}
+
+	if err := c.Valid(); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, c)
+
+	return nil
+}
+
+func (t *Tools) ClearCookie(w http.ResponseWriter, name string) error {
+	return t.SetCookie(w, CookieOptions{
+		Name:    name,
+		MaxAge:  -1,
+		Expires: time.Unix(0, 0),
+	})
+}
+
+// signURLPayload covers the path as well as the file and expiry, so a
+// link signed for one endpoint does not verify on another.
+func signURLPayload(path, fileName, expires, secret string) string {
+	if path == "" {
+		path = "/"
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path + "\n" + fileName + "\n" + expires))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (t *Tools) SignedURL(baseURL, fileName string, secret string, ttl time.Duration) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL: %w", err)
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+
+	query := u.Query()
+	query.Set("file", fileName)
+	query.Set("expires", expires)
+	query.Set("signature", signURLPayload(u.Path, fileName, expires, secret))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+func (t *Tools) VerifySignedURL(r *http.Request, secret string) (string, error) {
+	query := r.URL.Query()
+
+	fileName, expires, signature := query.Get("file"), query.Get("expires"), query.Get("signature")
+	if fileName == "" || expires == "" || signature == "" {
+		return "", errors.New("URL is not signed")
+	}
+
+	expected := signURLPayload(r.URL.Path, fileName, expires, secret)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", errors.New("URL signature is invalid")
+	}
+
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", errors.New("URL signature is invalid")
+	}
+
+	if time.Now().Unix() > unix {
+		return "", errors.New("URL has expired")
+	}
+
+	return fileName, nil
+}
+
+func (t *Tools) checkRemoteURI(uri string) error {
+	if !t.RequireHTTPS {
+		return nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(u.Scheme, "https") {
+		return fmt.Errorf("remote URI %s must use https", u.Redacted())
+	}
+
+	return nil
+}
+
+const defaultMaxIdleConnsPerHost = 16
+
+func (t *Tools) httpClient(client ...*http.Client) *http.Client {
 	if len(client) > 0 {
-		httpClient = client[0]
+		return client[0]
+	}
+
+	// one client per Tools so connections are pooled across calls; the
+	// transport settings are read once, on first use
+	state := t.runtimeState()
+
+	state.clientOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+
+		if t.HTTPMaxIdleConns > 0 {
+			transport.MaxIdleConns = t.HTTPMaxIdleConns
+		}
+		if t.HTTPMaxIdleConnsPerHost > 0 {
+			transport.MaxIdleConnsPerHost = t.HTTPMaxIdleConnsPerHost
+		}
+		if t.HTTPIdleConnTimeout > 0 {
+			transport.IdleConnTimeout = t.HTTPIdleConnTimeout
+		}
+
+		state.client = &http.Client{Transport: transport, Timeout: t.HTTPTimeout}
+	})
+
+	return state.client
+}
+
+func (t *Tools) FetchJSON(uri string, data any, client ...*http.Client) (int, error) {
+	if err := t.checkRemoteURI(uri); err != nil {
+		return 0, err
 	}
 
-	request, err := http.NewRequest("POST", uri, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
-		return nil, 0, err
+		return 0, err
+	}
+
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Accept-Encoding", "gzip, deflate, br")
+
+	response, err := t.httpClient(client...).Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("remote responded with status %d", response.StatusCode)
+	}
+
+	body, err := decompressBody(response.Body, response.Header.Get("Content-Encoding"))
+	if err != nil {
+		return response.StatusCode, err
+	}
+
+	maxBytes := t.MaxJSONSize
+	if maxBytes == 0 {
+		maxBytes = 1024 * 1024
+	}
+
+	dec := json.NewDecoder(io.LimitReader(body, int64(maxBytes)+1))
+	if t.JSONUseNumber {
+		dec.UseNumber()
+	}
+
+	if err := dec.Decode(data); err != nil {
+		if dec.InputOffset() > int64(maxBytes) {
+			return response.StatusCode, fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		}
+		return response.StatusCode, decodeJSONError(err, maxBytes)
+	}
+
+	return response.StatusCode, nil
+}
+
+func decompressBody(body io.Reader, encoding string) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "br":
+		return brotli.NewReader(body), nil
+	case "deflate":
+		// deflate is meant to be zlib wrapped, but some servers send raw deflate
+		br := bufio.NewReader(body)
+		header, err := br.Peek(2)
+		if err == nil && header[0]&0x0F == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+}
+
+func (t *Tools) GenerateCSRFToken() (string, error) {
+	return base64.RawURLEncoding.EncodeToString(secureRandomBytes(32)), nil
+}
+
+func (t *Tools) ValidateCSRFToken(fromForm, fromSession string) bool {
+	if fromForm == "" || fromSession == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(fromForm), []byte(fromSession)) == 1
+}
+
+func (t *Tools) ProxyJSON(w http.ResponseWriter, r *http.Request, upstreamURI string, client ...*http.Client) error {
+	defer t.observe("push_json", time.Now())
+
+	if err := t.checkRemoteURI(upstreamURI); err != nil {
+		return err
+	}
+
+	maxBytes, err := t.limitJSONBody(w, r)
+	if err != nil {
+		return err
+	}
+
+	body, err := t.readUTF8Body(r, maxBytes)
+	if err != nil {
+		return err
+	}
+
+	if !json.Valid(body) {
+		return t.requestError(errors.New("body contains badly formed JSON"))
+	}
+
+	request, err := http.NewRequestWithContext(r.Context(), "POST", upstreamURI, bytes.NewReader(body))
+	if err != nil {
+		return err
 	}
 
 	request.Header.Set("Content-Type", "application/json")
 
-	response, err := httpClient.Do(request)
+	response, err := t.httpClient(client...).Do(request)
 	if err != nil {
-		return nil, 0, err
+		return err
 	}
 	defer response.Body.Close()
 
-	return response, response.StatusCode, nil
+	if contentType := response.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(response.StatusCode)
+
+	_, err = io.Copy(w, response.Body)
+	return err
 }
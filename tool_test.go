@@ -1,7 +1,15 @@
 package toolkit
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,12 +18,26 @@ import (
 	"io"
 	"io/ioutil"
 
+	"math"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type RoundTripFunc func(req *http.Request) *http.Response
@@ -52,6 +74,220 @@ func TestTools_PushJSONToRemote(t *testing.T) {
 	}
 }
 
+func TestTools_PushJSONToMany(t *testing.T) {
+	var inFlight, peak atomic.Int32
+
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		body, _ := io.ReadAll(req.Body)
+		status := http.StatusOK
+		if req.URL.Path == "/fail" || string(body) != `{"event":"ping"}` {
+			status = http.StatusInternalServerError
+		}
+
+		return &http.Response{
+			StatusCode: status,
+			Body:       io.NopCloser(strings.NewReader("")),
+			Header:     make(http.Header),
+		}
+	})
+
+	var tools Tools
+	tools.RequireHTTPS = true
+
+	uris := []string{
+		"https://a.example.com/hook",
+		"https://b.example.com/fail",
+		"http://c.example.com/hook",
+		"https://d.example.com/hook",
+		"https://e.example.com/hook",
+		"https://f.example.com/hook",
+	}
+
+	results := tools.PushJSONToMany(uris, map[string]string{"event": "ping"}, 2, client)
+
+	if len(results) != len(uris) {
+		t.Fatalf("expected %d results, got %d", len(uris), len(results))
+	}
+
+	for i, result := range results {
+		if result.URI != uris[i] {
+			t.Errorf("result %d: expected URI %s, got %s", i, uris[i], result.URI)
+		}
+
+		switch i {
+		case 1:
+			if result.Err != nil || result.StatusCode != http.StatusInternalServerError {
+				t.Errorf("result %d: expected status 500, got %d (%v)", i, result.StatusCode, result.Err)
+			}
+		case 2:
+			if result.Err == nil {
+				t.Errorf("result %d: expected error for plain HTTP URI", i)
+			}
+		default:
+			if result.Err != nil || result.StatusCode != http.StatusOK {
+				t.Errorf("result %d: expected status 200, got %d (%v)", i, result.StatusCode, result.Err)
+			}
+		}
+	}
+
+	if peak.Load() > 2 {
+		t.Errorf("expected at most 2 concurrent pushes, saw %d", peak.Load())
+	}
+
+	if results := tools.PushJSONToMany(nil, "data", 4, client); len(results) != 0 {
+		t.Errorf("expected no results for no URIs, got %d", len(results))
+	}
+}
+
+func TestTools_PushJSONToRemoteSingleflight(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		calls.Add(1)
+		<-release
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(strings.NewReader("")),
+			Header:     make(http.Header),
+		}
+	})
+
+	var tools Tools
+
+	const callers = 10
+	statuses := make(chan int, callers)
+	var started, wg sync.WaitGroup
+	started.Add(callers)
+
+	for range callers {
+		wg.Go(func() {
+			started.Done()
+			_, status, err := tools.PushJSONToRemoteSingleflight("warmup", "https://example.com/cache", "data", client)
+			if err != nil {
+				t.Error(err)
+			}
+			statuses <- status
+		})
+	}
+
+	started.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		if status != http.StatusAccepted {
+			t.Errorf("expected shared status 202, got %d", status)
+		}
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected a single upstream call, got %d", n)
+	}
+
+	if _, _, err := tools.PushJSONToRemoteSingleflight("warmup", "https://example.com/cache", "data", client); err != nil {
+		t.Error(err)
+	}
+
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected a new call once the first one finished, got %d calls", n)
+	}
+}
+
+var configTests = []struct {
+	name          string
+	allowedTypes  []string
+	errorExpected bool
+}{
+	{name: "no types", allowedTypes: nil, errorExpected: false},
+	{name: "valid types", allowedTypes: []string{"image/jpeg", "text/plain; charset=utf-8"}, errorExpected: false},
+	{name: "typo in top-level type", allowedTypes: []string{"image/png", "img/jpeg"}, errorExpected: true},
+	{name: "missing subtype", allowedTypes: []string{"image"}, errorExpected: true},
+	{name: "malformed", allowedTypes: []string{"image/jpeg;;"}, errorExpected: true},
+}
+
+func TestTools_ValidateConfig(t *testing.T) {
+	for _, test := range configTests {
+		var tools Tools
+		tools.AllowedFileTypes = test.allowedTypes
+
+		err := tools.ValidateConfig()
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+	}
+
+	tools := Tools{MaxFileSize: -1}
+	if err := tools.ValidateConfig(); err == nil {
+		t.Error("expected error for negative max file size")
+	}
+	tools = Tools{MaxFilenameLength: -1}
+	if err := tools.ValidateConfig(); err == nil {
+		t.Error("expected error for negative max filename length")
+	}
+}
+
+func TestTools_UploadFilesNegativeMaxFilenameLength(t *testing.T) {
+	img := readTestImage(t)
+
+	var tools Tools
+	tools.MaxFilenameLength = -1
+
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+
+	uploadedFiles, err := tools.UploadFiles(request, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFiles[0].NewFileName != "cat.jpg" {
+		t.Errorf("expected the default limit to apply, got %q", uploadedFiles[0].NewFileName)
+	}
+}
+
+func TestTools_PushJSONToRemoteRequireHTTPS(t *testing.T) {
+	called := false
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		called = true
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewBufferString("ok")),
+			Header:     make(http.Header),
+		}
+	})
+
+	var tools Tools
+	tools.RequireHTTPS = true
+
+	if _, _, err := tools.PushJSONToRemote("http://example.com/test", "data", client); err == nil {
+		t.Error("expected http URI to be rejected")
+	}
+
+	if called {
+		t.Error("no request should be sent to a cleartext URI")
+	}
+
+	if _, _, err := tools.PushJSONToRemote("https://example.com/test", "data", client); err != nil {
+		t.Errorf("https URI should be accepted: %s", err)
+	}
+}
+
 func TestTools_RandomString(t *testing.T) {
 	var testTools Tools
 
@@ -62,6 +298,73 @@ func TestTools_RandomString(t *testing.T) {
 	}
 }
 
+func TestTools_RandomQRAlphanumeric(t *testing.T) {
+	var testTools Tools
+
+	s := testTools.RandomQRAlphanumeric(1000)
+
+	if len(s) != 1000 {
+		t.Errorf("wrong random string length %d", len(s))
+	}
+
+	if i := strings.IndexFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:", r)
+	}); i >= 0 {
+		t.Errorf("character %q is not in the QR alphanumeric set", s[i])
+	}
+}
+
+func TestTools_SeedRandom(t *testing.T) {
+	var first, second, other Tools
+
+	first.SeedRandom(42)
+	second.SeedRandom(42)
+	other.SeedRandom(7)
+
+	a, b, c := first.RandomString(20), second.RandomString(20), other.RandomString(20)
+
+	if a != b {
+		t.Errorf("same seed produced different strings: %s != %s", a, b)
+	}
+
+	if a == c {
+		t.Errorf("different seeds produced the same string: %s", a)
+	}
+
+	if first.RandomString(20) == a {
+		t.Error("seeded source should advance between calls")
+	}
+}
+
+func TestTools_GenerateID(t *testing.T) {
+	var tools Tools
+
+	first := tools.GenerateID()
+	time.Sleep(2 * time.Millisecond)
+	second := tools.GenerateID()
+
+	if len(first) != 26 {
+		t.Errorf("expected id of 26 characters, got %d", len(first))
+	}
+
+	if strings.Trim(first, crockfordBase32) != "" {
+		t.Errorf("id contains characters outside the alphabet: %s", first)
+	}
+
+	if first >= second {
+		t.Errorf("ids do not sort by creation time: %s >= %s", first, second)
+	}
+
+	seen := make(map[string]bool)
+	for range 1000 {
+		id := tools.GenerateID()
+		if seen[id] {
+			t.Fatalf("duplicate id generated: %s", id)
+		}
+		seen[id] = true
+	}
+}
+
 var uploadTests = []struct {
 	name          string
 	allowedTypes  []string
@@ -243,6 +546,34 @@ func TestTools_Slugify(t *testing.T) {
 	}
 }
 
+var stopWordSlugTests = []struct {
+	name     string
+	s        string
+	expected string
+}{
+	{name: "title", s: "The Lord of the Rings", expected: "lord-rings"},
+	{name: "no stop words", s: "Go Programming", expected: "go-programming"},
+	{name: "only stop words", s: "The Of A", expected: "the-of-a"},
+	{name: "stop word inside word", s: "Theory of Atoms", expected: "theory-atoms"},
+}
+
+func TestTools_SlugifyWithOptions(t *testing.T) {
+	var tools Tools
+
+	opts := SlugOptions{StopWords: []string{"the", "a", "of"}}
+
+	for _, test := range stopWordSlugTests {
+		slug, err := tools.SlugifyWithOptions(test.s, opts)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if slug != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, slug)
+		}
+	}
+}
+
 func TestTools_DownloadStaticFile(t *testing.T) {
 	rr := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/", nil)
@@ -268,99 +599,4365 @@ func TestTools_DownloadStaticFile(t *testing.T) {
 	}
 }
 
-var JSONTests = []struct {
-	name          string
-	json          string
-	errorExpected bool
-	maxSize       int
-	allowUnknown  bool
-}{
-	{name: "valid json", json: `{"foo": "bar"}`, errorExpected: false, maxSize: 1024, allowUnknown: false},
-	{name: "invalid json", json: `{"foo": }`, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "wrong json type", json: `{"foo": 1}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "too many objects", json: `{"foo": "bar"}{"foo": "baz"}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "empty body", json: ``, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "syntax error", json: `{"foo": "bar}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "unknown field", json: `{"x": "bar"}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "unknown fields allowed", json: `{"x": "bar"}`, errorExpected: false, maxSize: 1024, allowUnknown: true},
-	{name: "missing field name", json: `{x: "bar"}`, errorExpected: true, maxSize: 1024, allowUnknown: true},
-	{name: "body is too large", json: `{"foo": "bar"}`, errorExpected: true, maxSize: 5, allowUnknown: false},
-	{name: "not a json", json: `lololo`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+func TestTools_ServeUpload(t *testing.T) {
+	var tools Tools
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "evil.html"), []byte("<script>alert(1)</script>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("../../../etc/passwd", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	tools.ServeUpload(rr, httptest.NewRequest("GET", "/", nil), dir, "evil.html")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+
+	expectedHeaders := map[string]string{
+		"Content-Type":           "application/octet-stream",
+		"X-Content-Type-Options": "nosniff",
+		"Content-Disposition":    `attachment; filename="evil.html"`,
+	}
+	for header, want := range expectedHeaders {
+		if got := rr.Header().Get(header); got != want {
+			t.Errorf("expected %s %q, got %q", header, want, got)
+		}
+	}
+
+	if rr.Body.String() != "<script>alert(1)</script>" {
+		t.Errorf("unexpected body %q", rr.Body.String())
+	}
+
+	for name, status := range map[string]int{
+		"../cat.jpg":  http.StatusBadRequest,
+		"/etc/passwd": http.StatusBadRequest,
+		"missing.txt": http.StatusNotFound,
+		"sub":         http.StatusNotFound,
+		"link":        http.StatusNotFound,
+	} {
+		rr := httptest.NewRecorder()
+		tools.ServeUpload(rr, httptest.NewRequest("GET", "/", nil), dir, name)
+
+		if rr.Code != status {
+			t.Errorf("%s: expected status %d, got %d", name, status, rr.Code)
+		}
+	}
 }
 
-func TestTools_ReadJSON(t *testing.T) {
+func TestTools_ServeStaticFileGzip(t *testing.T) {
 	var tools Tools
 
-	for _, test := range JSONTests {
-		tools.MaxJSONSize = test.maxSize
-		tools.JSONAllowUnknownFields = test.allowUnknown
+	dir := t.TempDir()
+	text := strings.Repeat(`{"hello": "world"}`, 500)
+	if err := os.WriteFile(filepath.Join(dir, "data.json"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
 
-		var decodedJSON struct {
-			Foo string `json:"foo"`
+	for i := range 2 {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+		rr := httptest.NewRecorder()
+		tools.ServeStaticFileGzip(rr, req, dir, "data.json", "data.json")
+
+		if rr.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("request %d: expected gzip encoding", i)
 		}
 
-		req, err := http.NewRequest("POST", "/", bytes.NewReader([]byte(test.json)))
-		if err != nil {
-			t.Error(err)
+		if rr.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("request %d: expected Vary header", i)
 		}
-		defer req.Body.Close()
 
-		rr := httptest.NewRecorder()
+		if rr.Body.Len() >= len(text) {
+			t.Errorf("request %d: body was not compressed", i)
+		}
 
-		err = tools.ReadJSON(rr, req, &decodedJSON)
-		if test.errorExpected && err == nil {
-			t.Error("error expected, none received")
+		zr, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatal(err)
 		}
 
-		if !test.errorExpected && err != nil {
-			t.Errorf("error was not expected, but received one: %s", err.Error())
+		decoded, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
 		}
-	}
-}
 
-func TestTools_WriteJSON(t *testing.T) {
-	var tools Tools
+		if string(decoded) != text {
+			t.Errorf("request %d: decompressed body does not match the file", i)
+		}
+	}
 
 	rr := httptest.NewRecorder()
-	payload := JSONResponse{
-		Error:   false,
-		Message: "foo",
+	tools.ServeStaticFileGzip(rr, httptest.NewRequest("GET", "/", nil), dir, "data.json", "data.json")
+
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != text {
+		t.Error("expected plain file for client without gzip support")
 	}
 
-	headers := make(http.Header)
-	headers.Add("Foo", "Bar")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
 
-	err := tools.WriteJSON(rr, http.StatusOK, payload, headers)
-	if err != nil {
-		t.Errorf("WriteJSON errored with error: %s", err.Error())
+	rr = httptest.NewRecorder()
+	tools.ServeStaticFileGzip(rr, req, "./testdata", "cat.jpg", "cat.jpg")
+
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.Len() != 88614 {
+		t.Error("expected already compressed image to be served as is")
 	}
 }
 
-func TestTools_ErrorJSON(t *testing.T) {
+func TestTools_ServeZip(t *testing.T) {
 	var tools Tools
 
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"images/cat.jpg": "./testdata/cat.jpg",
+		"notes.txt":      filepath.Join(dir, "notes.txt"),
+		"missing.txt":    filepath.Join(dir, "missing.txt"),
+	}
+
 	rr := httptest.NewRecorder()
-	err := tools.ErrorJSON(rr, errors.New("Foo"), http.StatusServiceUnavailable)
-	if err != nil {
-		t.Errorf("ErrorJSON failed: %v", err)
+	if err := tools.ServeZip(rr, "bundle.zip", files); err == nil {
+		t.Error("expected error for missing source file")
 	}
 
-	var payload JSONResponse
-	decoder := json.NewDecoder(rr.Body)
-	err = decoder.Decode(&payload)
+	if rr.Body.Len() != 0 {
+		t.Error("nothing should be written when a source file is missing")
+	}
+
+	tools.ZipSkipMissing = true
+
+	rr = httptest.NewRecorder()
+	if err := tools.ServeZip(rr, "bundle.zip", files); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Header().Get("Content-Type") != "application/zip" {
+		t.Errorf("wrong content type %q", rr.Header().Get("Content-Type"))
+	}
+
+	if rr.Header().Get("Content-Disposition") != `attachment; filename="bundle.zip"` {
+		t.Errorf("wrong content disposition %q", rr.Header().Get("Content-Disposition"))
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
 	if err != nil {
-		t.Error("Received error while decoding json", err)
+		t.Fatal(err)
 	}
 
-	if !payload.Error {
-		t.Error("Error set to false, should be true")
+	sizes := map[string]uint64{}
+	for _, f := range zr.File {
+		sizes[f.Name] = f.UncompressedSize64
 	}
 
-	if rr.Code != http.StatusServiceUnavailable {
-		t.Errorf("Status set to %v, should be %v", rr.Code, http.StatusServiceUnavailable)
+	if len(sizes) != 2 || sizes["images/cat.jpg"] != 88614 || sizes["notes.txt"] != 9 {
+		t.Errorf("unexpected archive contents %v", sizes)
 	}
 
-	if payload.Message != "Foo" {
-		t.Errorf("Message set to %s, should be %s", payload.Message, "Foo")
+	if err := tools.ServeZip(httptest.NewRecorder(), "bad.zip", map[string]string{"../escape.txt": "./testdata/cat.jpg"}); err == nil {
+		t.Error("expected error for archive name escaping the root")
+	}
+}
+
+func TestTools_ServeThrottled(t *testing.T) {
+	var tools Tools
+
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789"), 2000)
+	path := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	tools.ServeThrottled(rr, httptest.NewRequest("GET", "/", nil), path, 100_000)
+	elapsed := time.Since(start)
+
+	if !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Fatalf("served %d bytes, expected %d", rr.Body.Len(), len(content))
+	}
+
+	// 20 kB at 100 kB/s should take about 200ms
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("download was not throttled, took %s", elapsed)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=100-109")
+
+	rr = httptest.NewRecorder()
+	tools.ServeThrottled(rr, req, path, 100_000)
+
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "0123456789" {
+		t.Errorf("expected partial content, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	tools.ServeThrottled(rr, httptest.NewRequest("GET", "/", nil), filepath.Join(dir, "missing.txt"), 100_000)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for missing file, got %d", rr.Code)
+	}
+}
+
+var safeJoinTests = []struct {
+	name          string
+	userPath      string
+	expected      string
+	errorExpected bool
+}{
+	{name: "plain file", userPath: "cat.jpg", expected: "testdata/cat.jpg"},
+	{name: "nested", userPath: "uploads/file.txt", expected: "testdata/uploads/file.txt"},
+	{name: "dot segments inside base", userPath: "uploads/../cat.jpg", expected: "testdata/cat.jpg"},
+	{name: "traversal", userPath: "../tool.go", errorExpected: true},
+	{name: "nested traversal", userPath: "uploads/../../tool.go", errorExpected: true},
+	{name: "absolute", userPath: "/etc/passwd", errorExpected: true},
+	{name: "empty", userPath: "", errorExpected: true},
+}
+
+func TestTools_SafeJoin(t *testing.T) {
+	var tools Tools
+
+	for _, test := range safeJoinTests {
+		joined, err := tools.SafeJoin("testdata", test.userPath)
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if joined != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, joined)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	tools.DownloadStaticFile(rr, httptest.NewRequest("GET", "/", nil), "./testdata", "../tool.go", "tool.go")
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected traversal download to be rejected, got status %d", rr.Code)
+	}
+}
+
+func TestTools_ServeStaticFileCompressed(t *testing.T) {
+	var tools Tools
+
+	dir := t.TempDir()
+	content := strings.Repeat("console.log('hello');\n", 100)
+
+	if err := os.WriteFile(dir+"/app.js", []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(content))
+	gz.Close()
+
+	if err := os.WriteFile(dir+"/app.js.gz", compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+
+	tools.ServeStaticFileCompressed(rr, req, dir, "app.js", "app.js")
+
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip encoding, got %q", rr.Header().Get("Content-Encoding"))
+	}
+
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/javascript") {
+		t.Errorf("wrong content type %s", rr.Header().Get("Content-Type"))
+	}
+
+	if rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("expected Vary header, got %q", rr.Header().Get("Vary"))
+	}
+
+	reader, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(decompressed) != content {
+		t.Error("decompressed body does not match the original file")
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+
+	tools.ServeStaticFileCompressed(rr, req, dir, "app.js", "app.js")
+
+	if rr.Header().Get("Content-Encoding") != "" {
+		t.Error("client refusing gzip should get the uncompressed file")
+	}
+
+	if rr.Body.String() != content {
+		t.Error("uncompressed body does not match the original file")
+	}
+}
+
+var rangeTests = []struct {
+	name         string
+	rangeHeader  string
+	status       int
+	body         string
+	contentRange string
+}{
+	{name: "no range", rangeHeader: "", status: http.StatusOK, body: "0123456789"},
+	{name: "closed range", rangeHeader: "bytes=2-5", status: http.StatusPartialContent, body: "2345", contentRange: "bytes 2-5/10"},
+	{name: "open range", rangeHeader: "bytes=7-", status: http.StatusPartialContent, body: "789", contentRange: "bytes 7-9/10"},
+	{name: "suffix range", rangeHeader: "bytes=-3", status: http.StatusPartialContent, body: "789", contentRange: "bytes 7-9/10"},
+	{name: "end past size", rangeHeader: "bytes=8-100", status: http.StatusPartialContent, body: "89", contentRange: "bytes 8-9/10"},
+	{name: "multiple ranges", rangeHeader: "bytes=0-1,4-5", status: http.StatusOK, body: "0123456789"},
+	{name: "unsatisfiable", rangeHeader: "bytes=20-30", status: http.StatusRequestedRangeNotSatisfiable, contentRange: "bytes */10"},
+	{name: "garbage", rangeHeader: "bytes=abc", status: http.StatusOK, body: "0123456789"},
+}
+
+func TestTools_StreamDownloadSeeker(t *testing.T) {
+	var tools Tools
+
+	for _, test := range rangeTests {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.rangeHeader != "" {
+			req.Header.Set("Range", test.rangeHeader)
+		}
+
+		err := tools.StreamDownloadSeeker(rr, req, strings.NewReader("0123456789"), 10, "digits.txt")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if rr.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rr.Code)
+		}
+
+		if test.status != http.StatusRequestedRangeNotSatisfiable && rr.Body.String() != test.body {
+			t.Errorf("%s: expected body %q, got %q", test.name, test.body, rr.Body.String())
+		}
+
+		if rr.Header().Get("Content-Range") != test.contentRange {
+			t.Errorf("%s: expected content range %q, got %q", test.name, test.contentRange, rr.Header().Get("Content-Range"))
+		}
+
+		if rr.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("%s: missing Accept-Ranges header", test.name)
+		}
+	}
+}
+
+var JSONTests = []struct {
+	name          string
+	json          string
+	errorExpected bool
+	maxSize       int
+	allowUnknown  bool
+}{
+	{name: "valid json", json: `{"foo": "bar"}`, errorExpected: false, maxSize: 1024, allowUnknown: false},
+	{name: "invalid json", json: `{"foo": }`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "wrong json type", json: `{"foo": 1}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "too many objects", json: `{"foo": "bar"}{"foo": "baz"}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "empty body", json: ``, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "syntax error", json: `{"foo": "bar}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "unknown field", json: `{"x": "bar"}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "unknown fields allowed", json: `{"x": "bar"}`, errorExpected: false, maxSize: 1024, allowUnknown: true},
+	{name: "missing field name", json: `{x: "bar"}`, errorExpected: true, maxSize: 1024, allowUnknown: true},
+	{name: "body is too large", json: `{"foo": "bar"}`, errorExpected: true, maxSize: 5, allowUnknown: false},
+	{name: "not a json", json: `lololo`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "leading BOM", json: "\uFEFF{\"foo\": \"bar\"}", errorExpected: false, maxSize: 1024, allowUnknown: false},
+}
+
+func TestTools_ReadJSON(t *testing.T) {
+	var tools Tools
+
+	for _, test := range JSONTests {
+		tools.MaxJSONSize = test.maxSize
+		tools.JSONAllowUnknownFields = test.allowUnknown
+
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		req, err := http.NewRequest("POST", "/", bytes.NewReader([]byte(test.json)))
+		if err != nil {
+			t.Error(err)
+		}
+		defer req.Body.Close()
+
+		rr := httptest.NewRecorder()
+
+		err = tools.ReadJSON(rr, req, &decodedJSON)
+		if test.errorExpected && err == nil {
+			t.Error("error expected, none received")
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("error was not expected, but received one: %s", err.Error())
+		}
+	}
+}
+
+type slowReader struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+
+	time.Sleep(s.delay)
+
+	n := copy(p[:1], s.data)
+	s.data = s.data[n:]
+
+	return n, nil
+}
+
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func TestTools_ReadJSONContentLength(t *testing.T) {
+	var tools Tools
+	tools.MaxJSONSize = 10
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	body := &countingReader{r: strings.NewReader(`{"foo": "a much longer value"}`)}
+	req := httptest.NewRequest("POST", "/", body)
+	req.ContentLength = 30
+
+	if err := tools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON); err == nil {
+		t.Error("error expected, none received")
+	}
+
+	if body.reads != 0 {
+		t.Errorf("body should not be read when Content-Length is too large, read %d times", body.reads)
+	}
+
+	body = &countingReader{r: strings.NewReader(`{"foo": "a much longer value"}`)}
+	req = httptest.NewRequest("POST", "/", body)
+	req.ContentLength = -1
+
+	if err := tools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON); err == nil {
+		t.Error("oversized body of unknown length should still be rejected")
+	}
+}
+
+func TestTools_ReadJSONProductionMode(t *testing.T) {
+	var tools Tools
+	tools.ProductionMode = true
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"foo": }`))
+
+	err := tools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON)
+	if err == nil {
+		t.Fatal("error expected, none received")
+	}
+
+	if err.Error() != "invalid request body" {
+		t.Errorf("detailed error leaked to client: %s", err)
+	}
+
+	var publicErr *PublicError
+	if !errors.As(err, &publicErr) {
+		t.Fatal("expected a PublicError")
+	}
+
+	if !strings.Contains(errors.Unwrap(err).Error(), "character") {
+		t.Errorf("detailed error should be available for logging, got %s", errors.Unwrap(err))
+	}
+}
+
+func TestTools_ReadJSONUseNumber(t *testing.T) {
+	var tools Tools
+	tools.JSONUseNumber = true
+
+	var decodedJSON map[string]any
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"id": 1234567890123456789}`))
+
+	if err := tools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	id, ok := decodedJSON["id"].(json.Number)
+	if !ok {
+		t.Fatalf("expected json.Number, got %T", decodedJSON["id"])
+	}
+
+	if n, err := id.Int64(); err != nil || n != 1234567890123456789 {
+		t.Errorf("precision lost decoding id: %s", id)
+	}
+}
+
+func TestTools_ReadJSONWithDefaults(t *testing.T) {
+	var tools Tools
+
+	type options struct {
+		Verbose bool `json:"verbose" default:"true"`
+	}
+
+	var payload struct {
+		Name    string   `json:"name" default:"anonymous"`
+		PerPage int      `json:"per_page" default:"20"`
+		Tags    []string `json:"tags" default:"a,b"`
+		Ratio   float64  `json:"ratio" default:"0.5"`
+		Options options  `json:"options"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"per_page": 50, "options": {}}`))
+
+	if err := tools.ReadJSONWithDefaults(httptest.NewRecorder(), req, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Name != "anonymous" || payload.PerPage != 50 || payload.Ratio != 0.5 || !payload.Options.Verbose {
+		t.Errorf("defaults not applied correctly: %+v", payload)
+	}
+
+	if !slices.Equal(payload.Tags, []string{"a", "b"}) {
+		t.Errorf("slice default not applied: %v", payload.Tags)
+	}
+
+	var bad struct {
+		Count int `json:"count" default:"many"`
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{}`))
+	if err := tools.ReadJSONWithDefaults(httptest.NewRecorder(), req, &bad); err == nil {
+		t.Error("expected error for unparseable default")
+	}
+}
+
+var allowedKeysTests = []struct {
+	name          string
+	json          string
+	errorExpected bool
+}{
+	{name: "allowed keys", json: `{"theme": "dark", "lang": "en"}`, errorExpected: false},
+	{name: "subset", json: `{"theme": "dark"}`, errorExpected: false},
+	{name: "unknown key", json: `{"theme": "dark", "admin": true}`, errorExpected: true},
+	{name: "not an object", json: `["theme"]`, errorExpected: true},
+	{name: "bad json", json: `{"theme": }`, errorExpected: true},
+}
+
+func TestTools_ReadJSONWithAllowedKeys(t *testing.T) {
+	var tools Tools
+
+	for _, test := range allowedKeysTests {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(test.json))
+
+		data, err := tools.ReadJSONWithAllowedKeys(httptest.NewRecorder(), req, []string{"theme", "lang"})
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if !test.errorExpected && data["theme"] != "dark" {
+			t.Errorf("%s: expected decoded data, got %v", test.name, data)
+		}
+	}
+}
+
+func TestTools_ReadJSONWithRaw(t *testing.T) {
+	var tools Tools
+
+	for _, test := range JSONTests {
+		tools.MaxJSONSize = test.maxSize
+		tools.JSONAllowUnknownFields = test.allowUnknown
+
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(test.json))
+
+		raw, err := tools.ReadJSONWithRaw(httptest.NewRecorder(), req, &decodedJSON)
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if !test.errorExpected && string(raw) != test.json {
+			t.Errorf("%s: expected raw body %q, got %q", test.name, test.json, raw)
+		}
+	}
+}
+
+func TestTools_ReadJSONWithTimeout(t *testing.T) {
+	var tools Tools
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	req := httptest.NewRequest("POST", "/", &slowReader{data: []byte(`{"foo": "bar"}`), delay: 20 * time.Millisecond})
+
+	err := tools.ReadJSONWithTimeout(httptest.NewRecorder(), req, &decodedJSON, 50*time.Millisecond)
+	if !errors.Is(err, ErrReadTimeout) {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"foo": "bar"}`))
+
+	err = tools.ReadJSONWithTimeout(httptest.NewRecorder(), req, &decodedJSON, time.Second)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if decodedJSON.Foo != "bar" {
+		t.Errorf("expected bar, got %s", decodedJSON.Foo)
+	}
+}
+
+func TestTools_WriteJSON(t *testing.T) {
+	var tools Tools
+
+	rr := httptest.NewRecorder()
+	payload := JSONResponse{
+		Error:   false,
+		Message: "foo",
+	}
+
+	headers := make(http.Header)
+	headers.Add("Foo", "Bar")
+
+	err := tools.WriteJSON(rr, http.StatusOK, payload, headers)
+	if err != nil {
+		t.Errorf("WriteJSON errored with error: %s", err.Error())
+	}
+}
+
+func TestTools_WriteNoContent(t *testing.T) {
+	var tools Tools
+
+	rr := httptest.NewRecorder()
+	rr.Header().Set("Content-Type", "application/json")
+
+	tools.WriteNoContent(rr)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("wrong status code %d", rr.Code)
+	}
+
+	if rr.Body.Len() != 0 {
+		t.Errorf("expected empty body, got %q", rr.Body.String())
+	}
+
+	if rr.Header().Get("Content-Type") != "" {
+		t.Errorf("expected no content type, got %s", rr.Header().Get("Content-Type"))
+	}
+}
+
+func TestTools_WriteJSONAlwaysEnvelope(t *testing.T) {
+	var tools Tools
+	tools.AlwaysEnvelope = true
+
+	rr := httptest.NewRecorder()
+	if err := tools.WriteJSON(rr, http.StatusOK, map[string]int{"count": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"error":false,"message":"","data":{"count":3}}`
+	if rr.Body.String() != expected {
+		t.Errorf("expected %s, got %s", expected, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	if err := tools.WriteJSON(rr, http.StatusOK, JSONResponse{Message: "done"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = `{"error":false,"message":"done"}`
+	if rr.Body.String() != expected {
+		t.Errorf("JSONResponse should pass through, got %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	if err := tools.WriteJSONCanonical(rr, http.StatusOK, map[string]int{"count": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = `{"data":{"count":3},"error":false,"message":""}`
+	if rr.Body.String() != expected {
+		t.Errorf("canonical envelope: expected %s, got %s", expected, rr.Body.String())
+	}
+}
+
+func TestTools_WriteJSONCanonical(t *testing.T) {
+	var tools Tools
+
+	type inner struct {
+		Zeta  int `json:"zeta"`
+		Alpha int `json:"alpha"`
+	}
+
+	payload := struct {
+		Name  string `json:"name"`
+		Big   int64  `json:"big"`
+		Inner inner  `json:"inner"`
+	}{Name: "foo", Big: 9007199254740993, Inner: inner{Zeta: 1, Alpha: 2}}
+
+	rr := httptest.NewRecorder()
+
+	if err := tools.WriteJSONCanonical(rr, http.StatusOK, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"big":9007199254740993,"inner":{"alpha":2,"zeta":1},"name":"foo"}`
+	if rr.Body.String() != expected {
+		t.Errorf("expected %s, got %s", expected, rr.Body.String())
+	}
+}
+
+func TestTools_WriteNDJSON(t *testing.T) {
+	var tools Tools
+
+	rr := httptest.NewRecorder()
+	items := []JSONResponse{{Message: "one"}, {Message: "two"}, {Message: "three"}}
+
+	i := 0
+	err := tools.WriteNDJSON(rr, http.StatusOK, func() (any, bool, error) {
+		if i == len(items) {
+			return nil, false, nil
+		}
+		i++
+		return items[i-1], true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("wrong content type %s", rr.Header().Get("Content-Type"))
+	}
+
+	if !rr.Flushed {
+		t.Error("expected response to be flushed")
+	}
+
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != len(items) {
+		t.Fatalf("expected %d lines, got %d", len(items), len(lines))
+	}
+
+	for i, line := range lines {
+		var payload JSONResponse
+		if err := json.Unmarshal([]byte(line), &payload); err != nil {
+			t.Fatal(err)
+		}
+
+		if payload.Message != items[i].Message {
+			t.Errorf("line %d: expected %s, got %s", i, items[i].Message, payload.Message)
+		}
+	}
+
+	err = tools.WriteNDJSON(httptest.NewRecorder(), http.StatusOK, func() (any, bool, error) {
+		return nil, false, errors.New("source failed")
+	})
+	if err == nil {
+		t.Error("expected error from source to be returned")
+	}
+}
+
+func TestTools_WriteRedirect(t *testing.T) {
+	var tools Tools
+
+	rr := httptest.NewRecorder()
+	if err := tools.WriteRedirect(rr, http.StatusSeeOther, "/login"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("wrong status %d", rr.Code)
+	}
+
+	if rr.Header().Get("Location") != "/login" {
+		t.Errorf("wrong location %s", rr.Header().Get("Location"))
+	}
+
+	if err := tools.WriteRedirect(httptest.NewRecorder(), http.StatusOK, "/login"); err == nil {
+		t.Error("expected error for non-redirect status")
+	}
+
+	if err := tools.WriteRedirect(httptest.NewRecorder(), http.StatusFound, ""); err == nil {
+		t.Error("expected error for empty location")
+	}
+
+	rr = httptest.NewRecorder()
+	if err := tools.WriteRedirectJSON(rr, http.StatusOK, "/dashboard"); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.TrimSpace(rr.Body.String()) != `{"redirect":"/dashboard"}` {
+		t.Errorf("wrong redirect payload %s", rr.Body.String())
+	}
+}
+
+func TestTools_ErrorJSON(t *testing.T) {
+	var tools Tools
+
+	rr := httptest.NewRecorder()
+	err := tools.ErrorJSON(rr, errors.New("Foo"), http.StatusServiceUnavailable)
+	if err != nil {
+		t.Errorf("ErrorJSON failed: %v", err)
+	}
+
+	var payload JSONResponse
+	decoder := json.NewDecoder(rr.Body)
+	err = decoder.Decode(&payload)
+	if err != nil {
+		t.Error("Received error while decoding json", err)
+	}
+
+	if !payload.Error {
+		t.Error("Error set to false, should be true")
+	}
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Status set to %v, should be %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	if payload.Message != "Foo" {
+		t.Errorf("Message set to %s, should be %s", payload.Message, "Foo")
+	}
+}
+
+var clientIPTests = []struct {
+	name       string
+	remoteAddr string
+	xff        string
+	realIP     string
+	expected   string
+}{
+	{name: "untrusted peer", remoteAddr: "203.0.113.7:1234", xff: "1.2.3.4", expected: "203.0.113.7"},
+	{name: "trusted peer no headers", remoteAddr: "10.0.0.1:1234", expected: "10.0.0.1"},
+	{name: "trusted peer with xff", remoteAddr: "10.0.0.1:1234", xff: "198.51.100.2", expected: "198.51.100.2"},
+	{name: "rightmost untrusted", remoteAddr: "10.0.0.1:1234", xff: "1.1.1.1, 198.51.100.2, 10.0.0.2", expected: "198.51.100.2"},
+	{name: "spoofed leftmost", remoteAddr: "10.0.0.1:1234", xff: "6.6.6.6, 198.51.100.2", expected: "198.51.100.2"},
+	{name: "all hops trusted", remoteAddr: "10.0.0.1:1234", xff: "10.0.0.3, 10.0.0.2", expected: "10.0.0.3"},
+	{name: "garbage in xff", remoteAddr: "10.0.0.1:1234", xff: "bogus, 198.51.100.2", expected: "198.51.100.2"},
+	{name: "real ip header", remoteAddr: "10.0.0.1:1234", realIP: "198.51.100.9", expected: "198.51.100.9"},
+	{name: "trusted ipv4 mapped peer", remoteAddr: "[::ffff:10.0.0.1]:1234", xff: "198.51.100.2", expected: "198.51.100.2"},
+}
+
+func TestTools_ClientIP(t *testing.T) {
+	var tools Tools
+
+	trusted := []string{"10.0.0.0/8", "192.168.1.1"}
+
+	for _, test := range clientIPTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.xff != "" {
+			req.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if test.realIP != "" {
+			req.Header.Set("X-Real-IP", test.realIP)
+		}
+
+		if ip := tools.ClientIP(req, trusted); ip != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, ip)
+		}
+	}
+}
+
+type testFilePart struct {
+	field    string
+	filename string
+	content  []byte
+}
+
+func newMultipartRequest(t *testing.T, parts ...testFilePart) *http.Request {
+	t.Helper()
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+
+	for _, p := range parts {
+		part, err := writer.CreateFormFile(p.field, p.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := part.Write(p.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+
+	return request
+}
+
+func readTestImage(t *testing.T) []byte {
+	t.Helper()
+
+	img, err := os.ReadFile("./testdata/cat.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return img
+}
+
+func TestTools_UploadFilesFieldName(t *testing.T) {
+	img := readTestImage(t)
+
+	var tools Tools
+	tools.UploadFieldName = "documents"
+
+	request := newMultipartRequest(t,
+		testFilePart{field: "documents", filename: "cat.jpg", content: img},
+		testFilePart{field: "sneaky", filename: "other.jpg", content: img},
+	)
+
+	uploadedFiles, err := tools.UploadFiles(request, "./testdata/uploads/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploadedFiles) != 1 {
+		t.Fatalf("expected 1 uploaded file, got %d", len(uploadedFiles))
+	}
+
+	if uploadedFiles[0].OriginalFileName != "cat.jpg" {
+		t.Errorf("wrong file uploaded: %s", uploadedFiles[0].OriginalFileName)
+	}
+
+	os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].NewFileName))
+
+	request = newMultipartRequest(t, testFilePart{field: "sneaky", filename: "other.jpg", content: img})
+
+	if _, err := tools.UploadFiles(request, "./testdata/uploads/"); err == nil {
+		t.Error("expected error when required field is missing")
+	}
+}
+
+func TestTools_UploadFilesStripBOM(t *testing.T) {
+	var tools Tools
+	tools.AllowedFileTypes = []string{"text/plain; charset=utf-8"}
+
+	for _, strip := range []bool{false, true} {
+		tools.StripBOM = strip
+
+		content := append([]byte("\uFEFF"), []byte("name,email\n")...)
+		request := newMultipartRequest(t, testFilePart{field: "file", filename: "bom.csv", content: content})
+
+		uploadedFile, err := tools.UploadFile(request, "./testdata/uploads/", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		saved, err := os.ReadFile(filepath.Join("./testdata/uploads/", uploadedFile.NewFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(filepath.Join("./testdata/uploads/", uploadedFile.NewFileName))
+
+		if hasBOM := bytes.HasPrefix(saved, []byte("\uFEFF")); hasBOM == strip {
+			t.Errorf("strip %t: BOM present in saved file: %t", strip, hasBOM)
+		}
+
+		if want := int64(len(saved)); uploadedFile.FileSize != want {
+			t.Errorf("strip %t: expected file size %d, got %d", strip, want, uploadedFile.FileSize)
+		}
+	}
+}
+
+func TestTools_UploadFilesDuplicateNames(t *testing.T) {
+	img := readTestImage(t)
+
+	newRequest := func() *http.Request {
+		return newMultipartRequest(t,
+			testFilePart{field: "file", filename: "cat.jpg", content: img},
+			testFilePart{field: "file", filename: "cat.jpg", content: img},
+			testFilePart{field: "file", filename: "cat (1).jpg", content: img},
+		)
+	}
+
+	var tools Tools
+
+	tools.DuplicateFileNames = DuplicatesReject
+	if _, err := tools.UploadFiles(newRequest(), t.TempDir()); err == nil {
+		t.Error("expected error for duplicate file names")
+	}
+
+	tools.DuplicateFileNames = DuplicatesRename
+	uploadedFiles, err := tools.UploadFiles(newRequest(), "./testdata/uploads/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct{ original, submitted string }{
+		{"cat.jpg", ""},
+		{"cat (1).jpg", "cat.jpg"},
+		{"cat (1) (1).jpg", "cat (1).jpg"},
+	}
+
+	if len(uploadedFiles) != len(expected) {
+		t.Fatalf("expected %d files, got %d", len(expected), len(uploadedFiles))
+	}
+
+	for i, f := range uploadedFiles {
+		os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+
+		if f.OriginalFileName != expected[i].original || f.SubmittedFileName != expected[i].submitted {
+			t.Errorf("file %d: expected %q from %q, got %q from %q",
+				i, expected[i].original, expected[i].submitted, f.OriginalFileName, f.SubmittedFileName)
+		}
+
+		if f.NewFileName != f.OriginalFileName {
+			t.Errorf("file %d: expected stored name %q, got %q", i, f.OriginalFileName, f.NewFileName)
+		}
+	}
+}
+
+func TestTools_UploadFilesFieldFileTypes(t *testing.T) {
+	img := readTestImage(t)
+	pdf := []byte("%PDF-1.4\n1 0 obj\n<<>>\nendobj\ntrailer\n<<>>\n%%EOF\n")
+
+	var tools Tools
+	tools.AllowedFileTypes = []string{"text/plain; charset=utf-8"}
+	tools.FieldFileTypes = map[string][]string{
+		"avatar":   {"image/jpeg", "image/png"},
+		"document": {"application/pdf"},
+	}
+
+	var fieldTests = []struct {
+		name          string
+		parts         []testFilePart
+		errorExpected bool
+	}{
+		{
+			name: "each field matches its rule",
+			parts: []testFilePart{
+				{field: "avatar", filename: "cat.jpg", content: img},
+				{field: "document", filename: "doc.pdf", content: pdf},
+				{field: "notes", filename: "notes.txt", content: []byte("hello")},
+			},
+		},
+		{name: "pdf as avatar", parts: []testFilePart{{field: "avatar", filename: "doc.pdf", content: pdf}}, errorExpected: true},
+		{name: "image as document", parts: []testFilePart{{field: "document", filename: "cat.jpg", content: img}}, errorExpected: true},
+		{name: "image in unconfigured field", parts: []testFilePart{{field: "notes", filename: "cat.jpg", content: img}}, errorExpected: true},
+	}
+
+	for _, test := range fieldTests {
+		_, err := tools.UploadFiles(newMultipartRequest(t, test.parts...), t.TempDir())
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+	}
+}
+
+func TestTools_UploadFilesScanFunc(t *testing.T) {
+	var tools Tools
+	tools.ScanFunc = func(name string, r io.Reader) error {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Contains(content, []byte("EICAR")) {
+			return fmt.Errorf("%s is infected", name)
+		}
+		return nil
+	}
+
+	dir := t.TempDir()
+
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "virus.txt", content: []byte("X5O!P%@AP EICAR test")})
+	if _, err := tools.UploadFiles(request, dir); err == nil {
+		t.Error("expected infected upload to be rejected")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected rejected upload to be deleted, found %d files", len(entries))
+	}
+
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "clean.txt", content: []byte("hello")})
+	uploadedFiles, err := tools.UploadFiles(request, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := os.ReadFile(filepath.Join(dir, uploadedFiles[0].NewFileName))
+	if err != nil || string(saved) != "hello" {
+		t.Errorf("clean upload was not stored intact: %q, %v", saved, err)
+	}
+}
+
+func TestTools_UploadFilesMaxUploadFileSize(t *testing.T) {
+	var tools Tools
+	tools.MaxUploadFileSize = 10
+
+	dir := t.TempDir()
+	batch := uploadBatch{dir: dir, maxFilenameLength: defaultMaxFilenameLength}
+
+	// a header with no content behind it fails on open, so rejecting it
+	// proves the size check runs before any bytes are read
+	hdr := &multipart.FileHeader{Filename: "huge.bin", Size: 1 << 40}
+	if _, err := tools.storeUpload("file", hdr, &batch); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("expected early size rejection, got %v", err)
+	}
+
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "big.txt", content: []byte("more than ten bytes")})
+	if err := request.ParseMultipartForm(1024); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr = request.MultipartForm.File["file"][0]
+	hdr.Size = 1
+
+	if _, err := tools.storeUpload("file", hdr, &batch); err == nil {
+		t.Error("expected copy to be stopped when the header under-reports the size")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected oversized upload to be removed, found %d files", len(entries))
+	}
+
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "small.txt", content: []byte("tiny")})
+	if _, err := tools.UploadFiles(request, dir); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestTools_RelayUpload(t *testing.T) {
+	img := readTestImage(t)
+
+	var received []byte
+	var contentType, disposition string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		disposition = r.Header.Get("Content-Disposition")
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	newRequest := func(content []byte) *http.Request {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		writer.WriteField("title", "a cat")
+
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="file"; filename="cat.jpg"`)
+		header.Set("Content-Type", "image/jpeg")
+		part, _ := writer.CreatePart(header)
+		part.Write(content)
+		writer.Close()
+
+		req := httptest.NewRequest("POST", "/", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req
+	}
+
+	var tools Tools
+
+	resp, err := tools.RelayUpload(newRequest(img), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected upstream status 201, got %d", resp.StatusCode)
+	}
+
+	if !bytes.Equal(received, img) {
+		t.Errorf("upstream received %d bytes, expected %d", len(received), len(img))
+	}
+
+	if contentType != "image/jpeg" || disposition != `attachment; filename="cat.jpg"` {
+		t.Errorf("unexpected upstream headers %q, %q", contentType, disposition)
+	}
+
+	tools.MaxUploadFileSize = 1024
+	if _, err := tools.RelayUpload(newRequest(img), server.URL); err == nil {
+		t.Error("expected error relaying a file over MaxUploadFileSize")
+	}
+
+	request := newMultipartRequest(t)
+	if _, err := tools.RelayUpload(request, server.URL); err == nil {
+		t.Error("expected error for form without a file")
+	}
+}
+
+func TestTools_UploadFilesExpectedSize(t *testing.T) {
+	var tools Tools
+	tools.ExpectedSize = func(r *http.Request, hdr *multipart.FileHeader) (int64, bool) {
+		size, err := strconv.ParseInt(r.Header.Get("X-File-Size"), 10, 64)
+		return size, err == nil
+	}
+
+	dir := t.TempDir()
+
+	// the connection dropped after 5 of the 11 declared bytes
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "short.txt", content: []byte("hello")})
+	request.Header.Set("X-File-Size", "11")
+
+	if _, err := tools.UploadFiles(request, dir); err == nil {
+		t.Error("expected truncated upload to be rejected")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected truncated upload to be deleted, found %d files", len(entries))
+	}
+
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "full.txt", content: []byte("hello world")})
+	request.Header.Set("X-File-Size", "11")
+
+	if _, err := tools.UploadFiles(request, dir); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "undeclared.txt", content: []byte("hello")})
+
+	if _, err := tools.UploadFiles(request, dir); err != nil {
+		t.Errorf("upload without a declared size should be accepted: %s", err)
+	}
+}
+
+func TestTools_UploadFilesExpectedSizeRewritten(t *testing.T) {
+	var tools Tools
+	tools.StripBOM = true
+	tools.SanitizeSVGUploads = true
+	tools.ExpectedSize = func(r *http.Request, hdr *multipart.FileHeader) (int64, bool) {
+		size, err := strconv.ParseInt(r.Header.Get("X-File-Size"), 10, 64)
+		return size, err == nil
+	}
+
+	dir := t.TempDir()
+
+	// the BOM is received but not stored
+	csv := append(slices.Clone(utf8BOM), []byte("name,qty\nab,1\n")...)
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "items.csv", content: csv})
+	request.Header.Set("X-File-Size", strconv.Itoa(len(csv)))
+
+	uploadedFiles, err := tools.UploadFiles(request, dir)
+	if err != nil {
+		t.Fatalf("complete upload with a BOM rejected: %s", err)
+	}
+
+	if uploadedFiles[0].FileSize != int64(len(csv)-len(utf8BOM)) {
+		t.Errorf("expected %d stored bytes, got %d", len(csv)-len(utf8BOM), uploadedFiles[0].FileSize)
+	}
+
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "items.csv", content: csv})
+	request.Header.Set("X-File-Size", strconv.Itoa(len(csv)+1))
+
+	if _, err := tools.UploadFiles(request, dir); err == nil {
+		t.Error("expected size mismatch to be rejected")
+	}
+
+	svg := []byte(`<svg onload="alert(1)"><rect/></svg>`)
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "logo.svg", content: svg})
+	request.Header.Set("X-File-Size", strconv.Itoa(len(svg)))
+
+	if _, err := tools.UploadFiles(request, dir); err != nil {
+		t.Errorf("complete sanitized upload rejected: %s", err)
+	}
+}
+
+func TestTools_UploadFileEmptyForm(t *testing.T) {
+	var tools Tools
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	writer.WriteField("title", "no attachment")
+	writer.Close()
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	uploadedFile, err := tools.UploadFile(request, t.TempDir())
+	if err == nil || err.Error() != "no files uploaded" {
+		t.Errorf("expected no files uploaded error, got %v", err)
+	}
+
+	if uploadedFile != nil {
+		t.Errorf("expected no uploaded file, got %+v", uploadedFile)
+	}
+}
+
+func TestTools_UploadFilesLongFilename(t *testing.T) {
+	img := readTestImage(t)
+
+	var tools Tools
+
+	longName := strings.Repeat("é", 200) + ".jpg"
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: longName, content: img})
+
+	uploadedFiles, err := tools.UploadFiles(request, "./testdata/uploads/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := uploadedFiles[0].NewFileName
+	defer os.Remove(fmt.Sprintf("./testdata/uploads/%s", name))
+
+	if len(name) > defaultMaxFilenameLength {
+		t.Errorf("file name is %d bytes, should be at most %d", len(name), defaultMaxFilenameLength)
+	}
+
+	if !utf8.ValidString(name) {
+		t.Error("file name was truncated in the middle of a rune")
+	}
+
+	if !strings.HasSuffix(name, ".jpg") {
+		t.Errorf("extension was not preserved: %s", name)
+	}
+
+	if uploadedFiles[0].OriginalFileName != longName {
+		t.Error("original file name should not be truncated")
+	}
+}
+
+func TestTools_DirSize(t *testing.T) {
+	var tools Tools
+
+	dir := t.TempDir()
+
+	if err := os.WriteFile(dir+"/a.txt", make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tools.CreateDirIfNotExists(dir + "/nested"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(dir+"/nested/b.txt", make([]byte, 50), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := tools.DirSize(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != 150 {
+		t.Errorf("expected dir size 150, got %d", size)
+	}
+
+	if _, err := tools.DirSize(dir + "/missing"); err == nil {
+		t.Error("expected error for missing directory")
+	}
+}
+
+func TestTools_UploadFilesMaxDirSize(t *testing.T) {
+	img := readTestImage(t)
+
+	var tools Tools
+	tools.MaxDirSize = int64(len(img)) - 1
+
+	dir := t.TempDir()
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+
+	if _, err := tools.UploadFiles(request, dir); err == nil {
+		t.Error("expected quota error")
+	}
+
+	tools.MaxDirSize = int64(len(img))
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+
+	if _, err := tools.UploadFiles(request, dir); err != nil {
+		t.Errorf("upload within quota failed: %s", err)
+	}
+}
+
+func TestTools_UploadFilesRequireExtension(t *testing.T) {
+	img := readTestImage(t)
+
+	var tools Tools
+	tools.RequireFileExtension = true
+
+	dir := t.TempDir()
+
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "noext", content: img})
+	if _, err := tools.UploadFiles(request, dir, false); err == nil {
+		t.Error("expected error for file without extension")
+	}
+
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "noext", content: img})
+	if _, err := tools.UploadFiles(request, dir, true); err != nil {
+		t.Errorf("renamed upload should not require an extension: %s", err)
+	}
+
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+	if _, err := tools.UploadFiles(request, dir, false); err != nil {
+		t.Errorf("upload with extension failed: %s", err)
+	}
+}
+
+var sortTests = []struct {
+	name          string
+	query         string
+	expected      []SortField
+	errorExpected bool
+}{
+	{name: "no sort", query: "", expected: nil},
+	{name: "single asc", query: "name", expected: []SortField{{Field: "name"}}},
+	{name: "mixed", query: "name,-created_at", expected: []SortField{{Field: "name"}, {Field: "created_at", Desc: true}}},
+	{name: "explicit asc", query: "+name", expected: []SortField{{Field: "name"}}},
+	{name: "not allowed", query: "password", errorExpected: true},
+	{name: "injection", query: "name;DROP TABLE users", errorExpected: true},
+	{name: "empty field", query: "name,,created_at", errorExpected: true},
+	{name: "only dash", query: "-", errorExpected: true},
+}
+
+func TestTools_ParseSort(t *testing.T) {
+	var tools Tools
+
+	allowed := []string{"name", "created_at"}
+
+	for _, test := range sortTests {
+		req := httptest.NewRequest("GET", "/?sort="+url.QueryEscape(test.query), nil)
+
+		fields, err := tools.ParseSort(req, allowed)
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if !slices.Equal(fields, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, fields)
+		}
+	}
+}
+
+func TestTools_EchoUpload(t *testing.T) {
+	img := readTestImage(t)
+
+	var tools Tools
+	tools.AllowedFileTypes = []string{"image/jpeg"}
+
+	rr := httptest.NewRecorder()
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+
+	if err := tools.EchoUpload(rr, request); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("wrong content type %s", rr.Header().Get("Content-Type"))
+	}
+
+	if !bytes.Equal(rr.Body.Bytes(), img) {
+		t.Error("echoed body does not match the upload")
+	}
+
+	tools.AllowedFileTypes = []string{"image/png"}
+
+	rr = httptest.NewRecorder()
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+
+	if err := tools.EchoUpload(rr, request); err == nil {
+		t.Error("expected error for disallowed file type")
+	}
+
+	if rr.Body.Len() != 0 {
+		t.Error("nothing should be written for a rejected upload")
+	}
+
+	rr = httptest.NewRecorder()
+	request = newMultipartRequest(t)
+
+	if err := tools.EchoUpload(rr, request); err == nil {
+		t.Error("expected error when no file is uploaded")
+	}
+
+	tools.AllowedFileTypes = nil
+
+	rr = httptest.NewRecorder()
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+
+	if err := tools.EchoUpload(rr, request); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := rr.Header().Get("Content-Disposition"); got != "" {
+		t.Errorf("images should be echoed inline, got %s", got)
+	}
+}
+
+func TestTools_EchoUploadHTML(t *testing.T) {
+	var tools Tools
+
+	rr := httptest.NewRecorder()
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "page.html", content: []byte("<html><script>alert(1)</script></html>")})
+
+	if err := tools.EchoUpload(rr, request); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := rr.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("expected nosniff, got %q", got)
+	}
+
+	if got := rr.Header().Get("Content-Security-Policy"); got != "default-src 'none'; sandbox" {
+		t.Errorf("expected a sandboxing CSP, got %q", got)
+	}
+
+	if got := rr.Header().Get("Content-Disposition"); !strings.HasPrefix(got, "attachment") {
+		t.Errorf("expected HTML to be sent as an attachment, got %q", got)
+	}
+}
+
+func TestTools_BuildMultipartRequest(t *testing.T) {
+	var tools Tools
+
+	f, err := os.Open("./testdata/cat.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	request, err := tools.BuildMultipartRequest(
+		"http://example.com/upload",
+		map[string]io.Reader{"avatar": f, "notes": strings.NewReader("hello")},
+		map[string]string{"title": "a cat"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := request.ParseMultipartForm(1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	if request.FormValue("title") != "a cat" {
+		t.Errorf("wrong title field %q", request.FormValue("title"))
+	}
+
+	avatar := request.MultipartForm.File["avatar"]
+	if len(avatar) != 1 || avatar[0].Filename != "cat.jpg" {
+		t.Fatalf("avatar file not found in request")
+	}
+
+	if avatar[0].Size != 88614 {
+		t.Errorf("wrong avatar size %d", avatar[0].Size)
+	}
+
+	notes := request.MultipartForm.File["notes"]
+	if len(notes) != 1 || notes[0].Filename != "notes" {
+		t.Errorf("notes file not found in request")
+	}
+}
+
+func TestTools_HashPassword(t *testing.T) {
+	var tools Tools
+	tools.BcryptCost = bcrypt.MinCost
+
+	hash, err := tools.HashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cost, err := bcrypt.Cost([]byte(hash)); err != nil || cost != bcrypt.MinCost {
+		t.Errorf("hash was not generated with configured cost: %d", cost)
+	}
+
+	if !tools.CheckPassword("correct horse battery staple", hash) {
+		t.Error("correct password was rejected")
+	}
+
+	if tools.CheckPassword("wrong password", hash) {
+		t.Error("wrong password was accepted")
+	}
+
+	if tools.CheckPassword("correct horse battery staple", "not a hash") {
+		t.Error("malformed hash was accepted")
+	}
+}
+
+var emailTests = []struct {
+	name          string
+	email         string
+	expected      string
+	errorExpected bool
+}{
+	{name: "simple", email: "user@example.com", expected: "user@example.com"},
+	{name: "trim and lowercase domain", email: "  John.Doe@Example.COM ", expected: "John.Doe@example.com"},
+	{name: "plus addressing", email: "user+tag@mail.example.org", expected: "user+tag@mail.example.org"},
+	{name: "empty", email: "   ", errorExpected: true},
+	{name: "no at", email: "userexample.com", errorExpected: true},
+	{name: "display name", email: "Bob <bob@example.com>", errorExpected: true},
+	{name: "no tld", email: "user@localhost", errorExpected: true},
+	{name: "numeric tld", email: "user@example.123", errorExpected: true},
+	{name: "bad label", email: "user@-example.com", errorExpected: true},
+	{name: "empty label", email: "user@example..com", errorExpected: true},
+	{name: "local too long", email: strings.Repeat("a", 65) + "@example.com", errorExpected: true},
+}
+
+func TestTools_ValidateEmail(t *testing.T) {
+	var tools Tools
+
+	for _, test := range emailTests {
+		normalized, err := tools.ValidateEmail(test.email)
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if normalized != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, normalized)
+		}
+	}
+}
+
+func TestTools_StoreContentAddressed(t *testing.T) {
+	var tools Tools
+
+	dir := t.TempDir()
+	content := "hello content addressed world"
+	sum := sha256.Sum256([]byte(content))
+	expectedName := hex.EncodeToString(sum[:]) + ".txt"
+
+	first, err := tools.StoreContentAddressed(strings.NewReader(content), dir, "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.NewFileName != expectedName {
+		t.Errorf("expected file name %s, got %s", expectedName, first.NewFileName)
+	}
+
+	if first.FileSize != int64(len(content)) {
+		t.Errorf("expected size %d, got %d", len(content), first.FileSize)
+	}
+
+	if first.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected checksum %x, got %s", sum, first.Checksum)
+	}
+
+	second, err := tools.StoreContentAddressed(strings.NewReader(content), dir, ".txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second.NewFileName != first.NewFileName {
+		t.Errorf("identical content stored under different names")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("expected exactly one stored file, found %d", len(entries))
+	}
+}
+
+var pdfTests = []struct {
+	name          string
+	content       string
+	errorExpected bool
+}{
+	{name: "valid pdf", content: "%PDF-1.4\n1 0 obj\n<<>>\nendobj\ntrailer\n<<>>\n%%EOF\n", errorExpected: false},
+	{name: "truncated pdf", content: "%PDF-1.4\n1 0 obj\n<<>>\nendobj\n", errorExpected: true},
+	{name: "not a pdf", content: "hello world %%EOF", errorExpected: true},
+	{name: "empty", content: "", errorExpected: true},
+	{name: "large valid pdf", content: "%PDF-1.7\n" + strings.Repeat("x", 100*1024) + "\n%%EOF", errorExpected: false},
+}
+
+func TestTools_ValidatePDF(t *testing.T) {
+	var tools Tools
+
+	for _, test := range pdfTests {
+		err := tools.ValidatePDF(strings.NewReader(test.content))
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+	}
+
+	tools.ValidatePDFUploads = true
+	dir := t.TempDir()
+
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "doc.pdf", content: []byte(pdfTests[1].content)})
+	if _, err := tools.UploadFiles(request, dir); err == nil {
+		t.Error("expected truncated PDF upload to be rejected")
+	}
+
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "doc.pdf", content: []byte(pdfTests[0].content)})
+	uploadedFiles, err := tools.UploadFiles(request, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFiles[0].FileSize != int64(len(pdfTests[0].content)) {
+		t.Errorf("stored PDF has wrong size %d", uploadedFiles[0].FileSize)
+	}
+}
+
+var csvTests = []struct {
+	name          string
+	content       string
+	maxRows       int
+	rows          int
+	errorExpected bool
+}{
+	{name: "valid", content: "name,email\nann,ann@example.com\nbob,bob@example.com\n", rows: 2},
+	{name: "extra columns", content: "id, Email ,name\n1,a@example.com,ann\n", rows: 1},
+	{name: "leading BOM", content: "\uFEFFname,email\nann,ann@example.com\n", rows: 1},
+	{name: "header only", content: "name,email\n", rows: 0},
+	{name: "missing column", content: "name,phone\nann,555\n", errorExpected: true},
+	{name: "ragged row", content: "name,email\nann\n", errorExpected: true},
+	{name: "bad quoting", content: "name,email\n\"ann,ann@example.com\n", errorExpected: true},
+	{name: "too many rows", content: "name,email\na,a\nb,b\nc,c\n", maxRows: 2, errorExpected: true},
+	{name: "empty", content: "", errorExpected: true},
+}
+
+func TestTools_ValidateCSV(t *testing.T) {
+	var tools Tools
+
+	for _, test := range csvTests {
+		rows, err := tools.ValidateCSV(strings.NewReader(test.content), []string{"name", "email"}, test.maxRows)
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if !test.errorExpected && rows != test.rows {
+			t.Errorf("%s: expected %d rows, got %d", test.name, test.rows, rows)
+		}
+	}
+
+	tools.ValidateCSVUploads = true
+	tools.CSVRequiredHeaders = []string{"name", "email"}
+	dir := t.TempDir()
+
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "import.csv", content: []byte(csvTests[4].content)})
+	if _, err := tools.UploadFiles(request, dir); err == nil {
+		t.Error("expected CSV upload without required columns to be rejected")
+	}
+
+	request = newMultipartRequest(t,
+		testFilePart{field: "file", filename: "import.CSV", content: []byte(csvTests[0].content)},
+		testFilePart{field: "file", filename: "notes.txt", content: []byte(csvTests[4].content)},
+	)
+	if _, err := tools.UploadFiles(request, dir); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+var idParamTests = []struct {
+	name          string
+	value         string
+	expected      int64
+	errorExpected bool
+}{
+	{name: "valid", value: "42", expected: 42},
+	{name: "zero", value: "0", expected: 0},
+	{name: "missing", value: "", errorExpected: true},
+	{name: "non-numeric", value: "abc", errorExpected: true},
+	{name: "negative", value: "-5", errorExpected: true},
+	{name: "overflow", value: "99999999999999999999", errorExpected: true},
+}
+
+func TestTools_ReadIDParam(t *testing.T) {
+	var tools Tools
+
+	for _, test := range idParamTests {
+		req := httptest.NewRequest("GET", "/users/"+test.value, nil)
+		if test.value != "" {
+			req.SetPathValue("id", test.value)
+		}
+
+		id, err := tools.ReadIDParam(req, "id")
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if id != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, id)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := tools.ReadIDParam(r, "id")
+		if err != nil || id != 7 {
+			t.Errorf("expected id 7 from mux, got %d (%v)", id, err)
+		}
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/7", nil))
+}
+
+type testLogger struct {
+	messages []string
+	args     [][]any
+}
+
+func (l *testLogger) Warn(msg string, args ...any) {
+	l.messages = append(l.messages, msg)
+	l.args = append(l.args, args)
+}
+
+func TestTools_SlowThreshold(t *testing.T) {
+	logger := &testLogger{}
+
+	var tools Tools
+	tools.Logger = logger
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"foo": "bar"}`))
+	if err := tools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logger.messages) != 0 {
+		t.Error("nothing should be logged without a threshold")
+	}
+
+	tools.SlowThreshold = time.Nanosecond
+
+	req = httptest.NewRequest("POST", "/", &slowReader{data: []byte(`{"foo": "bar"}`), delay: time.Millisecond})
+	if err := tools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logger.messages) != 1 {
+		t.Fatalf("expected one slow operation warning, got %d", len(logger.messages))
+	}
+
+	if logger.args[0][1] != "read_json" {
+		t.Errorf("wrong operation logged: %v", logger.args[0])
+	}
+}
+
+var languageTests = []struct {
+	name           string
+	acceptLanguage string
+	expected       string
+}{
+	{name: "no header", acceptLanguage: "", expected: "en"},
+	{name: "exact match", acceptLanguage: "de", expected: "de"},
+	{name: "quality order", acceptLanguage: "fr;q=0.5, de;q=0.9", expected: "de"},
+	{name: "region falls back to base", acceptLanguage: "de-AT", expected: "de"},
+	{name: "base matches region", acceptLanguage: "pt", expected: "pt-BR"},
+	{name: "case insensitive", acceptLanguage: "PT-br", expected: "pt-BR"},
+	{name: "unsupported", acceptLanguage: "ja, zh;q=0.8", expected: "en"},
+	{name: "zero quality ignored", acceptLanguage: "de;q=0, fr;q=0.1", expected: "fr"},
+	{name: "wildcard", acceptLanguage: "ja, *;q=0.5", expected: "en"},
+}
+
+func TestTools_NegotiateLanguage(t *testing.T) {
+	var tools Tools
+
+	supported := []string{"en", "de", "fr", "pt-BR"}
+
+	for _, test := range languageTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", test.acceptLanguage)
+
+		if lang := tools.NegotiateLanguage(req, supported, "en"); lang != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, lang)
+		}
+	}
+}
+
+type testQuery struct {
+	Search   string        `query:"q"`
+	Page     int           `query:"page" default:"1"`
+	PerPage  uint8         `query:"per_page" default:"20"`
+	Active   bool          `query:"active"`
+	Tags     []string      `query:"tag"`
+	IDs      []int64       `query:"id" default:"1,2"`
+	MinScore float64       `query:"min_score"`
+	Window   time.Duration `query:"window" default:"1h"`
+	Ignored  string
+}
+
+func TestTools_ReadQuery(t *testing.T) {
+	var tools Tools
+
+	req := httptest.NewRequest("GET", "/?q=cats&active=true&tag=a&tag=b&min_score=0.5&page=3", nil)
+
+	var query testQuery
+	if err := tools.ReadQuery(req, &query); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := testQuery{
+		Search:   "cats",
+		Page:     3,
+		PerPage:  20,
+		Active:   true,
+		Tags:     []string{"a", "b"},
+		IDs:      []int64{1, 2},
+		MinScore: 0.5,
+		Window:   time.Hour,
+	}
+
+	if fmt.Sprint(query) != fmt.Sprint(expected) {
+		t.Errorf("expected %+v, got %+v", expected, query)
+	}
+
+	badQueries := []string{"page=abc", "active=maybe", "per_page=300", "id=1&id=x", "window=soon"}
+	for _, q := range badQueries {
+		var query testQuery
+		if err := tools.ReadQuery(httptest.NewRequest("GET", "/?"+q, nil), &query); err == nil {
+			t.Errorf("expected error for %s", q)
+		}
+	}
+
+	if err := tools.ReadQuery(req, query); err == nil {
+		t.Error("expected error for non-pointer destination")
+	}
+}
+
+func TestTools_CopyValue(t *testing.T) {
+	base := Tools{MaxJSONSize: 1024}
+
+	// copying a Tools value must not copy locks, so go vet keeps this honest
+	copied := base
+	copied.MaxJSONSize = 2048
+
+	if base.MaxJSONSize != 1024 {
+		t.Error("changing a copy changed the original")
+	}
+
+	base.observe("read_json", time.Now())
+
+	shared := base
+	shared.observe("read_json", time.Now())
+
+	if n := base.Stats().JSONReads.Count; n != 2 {
+		t.Errorf("expected copies made after first use to share stats, got %d reads", n)
+	}
+
+	if base.httpClient() != shared.httpClient() {
+		t.Error("expected copies made after first use to share the HTTP client")
+	}
+
+	if n := copied.Stats().JSONReads.Count; n != 0 {
+		t.Errorf("expected a copy made before first use to have its own stats, got %d reads", n)
+	}
+}
+
+func TestTools_StateFirstUseConcurrent(t *testing.T) {
+	var tools Tools
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Go(func() {
+			tools.observe("read_json", time.Now())
+		})
+	}
+	wg.Wait()
+
+	if n := tools.Stats().JSONReads.Count; n != 50 {
+		t.Errorf("expected 50 reads counted, got %d", n)
+	}
+}
+
+func TestTools_Stats(t *testing.T) {
+	var tools Tools
+
+	if stats := tools.Stats(); stats.JSONReads.Count != 0 || stats.JSONReads.Average != 0 {
+		t.Errorf("expected empty stats, got %+v", stats)
+	}
+
+	for range 3 {
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"foo": "bar"}`))
+		if err := tools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tools.WriteJSON(httptest.NewRecorder(), http.StatusOK, "ok"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := tools.Stats()
+
+	if stats.JSONReads.Count != 3 {
+		t.Errorf("expected 3 JSON reads, got %d", stats.JSONReads.Count)
+	}
+
+	if stats.JSONReads.Average != stats.JSONReads.Total/3 {
+		t.Errorf("wrong average %s for total %s", stats.JSONReads.Average, stats.JSONReads.Total)
+	}
+
+	if stats.JSONWrites.Count != 1 {
+		t.Errorf("expected 1 JSON write, got %d", stats.JSONWrites.Count)
+	}
+
+	if stats.Uploads.Count != 0 || stats.RemotePushes.Count != 0 {
+		t.Errorf("unexpected counts %+v", stats)
+	}
+}
+
+func TestTools_UploadFilesBestEffort(t *testing.T) {
+	img := readTestImage(t)
+
+	var tools Tools
+	tools.AllowedFileTypes = []string{"image/jpeg"}
+
+	request := newMultipartRequest(t,
+		testFilePart{field: "file", filename: "cat.jpg", content: img},
+		testFilePart{field: "file", filename: "cat.exe", content: []byte("MZ\x90\x00 not really an executable")},
+	)
+
+	result, err := tools.UploadFilesBestEffort(request, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Files) != 1 || result.Files[0].OriginalFileName != "cat.jpg" {
+		t.Errorf("expected cat.jpg to be accepted, got %+v", result.Files)
+	}
+
+	if len(result.Rejected) != 1 {
+		t.Fatalf("expected one rejected file, got %d", len(result.Rejected))
+	}
+
+	if result.Rejected[0].Name != "cat.exe" || result.Rejected[0].Reason != "uploaded file type is not permitted" {
+		t.Errorf("unexpected rejection %+v", result.Rejected[0])
+	}
+}
+
+var paginationLinkTests = []struct {
+	name     string
+	page     int
+	total    int
+	expected []string
+}{
+	{name: "first page", page: 1, total: 45, expected: []string{
+		`<https://api.example.com/items?page=2&per_page=10&q=cat>; rel="next"`,
+		`<https://api.example.com/items?page=1&per_page=10&q=cat>; rel="first"`,
+		`<https://api.example.com/items?page=5&per_page=10&q=cat>; rel="last"`,
+	}},
+	{name: "middle page", page: 3, total: 45, expected: []string{
+		`<https://api.example.com/items?page=4&per_page=10&q=cat>; rel="next"`,
+		`<https://api.example.com/items?page=2&per_page=10&q=cat>; rel="prev"`,
+		`<https://api.example.com/items?page=1&per_page=10&q=cat>; rel="first"`,
+		`<https://api.example.com/items?page=5&per_page=10&q=cat>; rel="last"`,
+	}},
+	{name: "last page", page: 5, total: 45, expected: []string{
+		`<https://api.example.com/items?page=4&per_page=10&q=cat>; rel="prev"`,
+		`<https://api.example.com/items?page=1&per_page=10&q=cat>; rel="first"`,
+		`<https://api.example.com/items?page=5&per_page=10&q=cat>; rel="last"`,
+	}},
+	{name: "no results", page: 1, total: 0, expected: []string{
+		`<https://api.example.com/items?page=1&per_page=10&q=cat>; rel="first"`,
+		`<https://api.example.com/items?page=1&per_page=10&q=cat>; rel="last"`,
+	}},
+	{name: "past the end", page: 9, total: 45, expected: []string{
+		`<https://api.example.com/items?page=5&per_page=10&q=cat>; rel="prev"`,
+		`<https://api.example.com/items?page=1&per_page=10&q=cat>; rel="first"`,
+		`<https://api.example.com/items?page=5&per_page=10&q=cat>; rel="last"`,
+	}},
+}
+
+func TestTools_SetPaginationLinks(t *testing.T) {
+	var tools Tools
+
+	for _, test := range paginationLinkTests {
+		rr := httptest.NewRecorder()
+
+		if err := tools.SetPaginationLinks(rr, "https://api.example.com/items?q=cat", test.page, 10, test.total); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if link := rr.Header().Get("Link"); link != strings.Join(test.expected, ", ") {
+			t.Errorf("%s: unexpected Link header %s", test.name, link)
+		}
+	}
+
+	if err := tools.SetPaginationLinks(httptest.NewRecorder(), "https://api.example.com/items", 1, 0, 10); err == nil {
+		t.Error("expected error for zero per page")
+	}
+}
+
+func TestTools_StreamUploads(t *testing.T) {
+	var tools Tools
+
+	request := newMultipartRequest(t,
+		testFilePart{field: "file", filename: "one.txt", content: []byte("first")},
+		testFilePart{field: "file", filename: "two.txt", content: []byte("second")},
+		testFilePart{field: "file", filename: "three.txt", content: []byte("third")},
+	)
+
+	var names, contents []string
+	err := tools.StreamUploads(request, func(part *multipart.Part) error {
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return err
+		}
+
+		names = append(names, part.FileName())
+		contents = append(contents, string(data))
+
+		if len(names) == 2 {
+			return errors.New("stop")
+		}
+		return nil
+	})
+
+	if err == nil || err.Error() != "stop" {
+		t.Errorf("expected handler error to stop streaming, got %v", err)
+	}
+
+	if !slices.Equal(names, []string{"one.txt", "two.txt"}) {
+		t.Errorf("unexpected parts processed: %v", names)
+	}
+
+	if !slices.Equal(contents, []string{"first", "second"}) {
+		t.Errorf("unexpected part contents: %v", contents)
+	}
+}
+
+func TestTools_UploadedFileJSON(t *testing.T) {
+	var tools Tools
+
+	rr := httptest.NewRecorder()
+	files := []*UploadedFile{{NewFileName: "abc.jpg", OriginalFileName: "cat.jpg", FileSize: 10}}
+
+	if err := tools.WriteJSON(rr, http.StatusCreated, files); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[{"new_file_name":"abc.jpg","original_file_name":"cat.jpg","file_size":10}]`
+	if rr.Body.String() != expected {
+		t.Errorf("expected %s, got %s", expected, rr.Body.String())
+	}
+}
+
+func compressTestBody(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		return data
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestTools_FetchJSON(t *testing.T) {
+	var tools Tools
+
+	payload := []byte(`{"foo": "bar"}`)
+
+	for _, encoding := range []string{"", "gzip", "deflate", "raw-deflate", "br"} {
+		body := compressTestBody(t, encoding, payload)
+
+		client := NewTestClient(func(req *http.Request) *http.Response {
+			if req.Header.Get("Accept-Encoding") != "gzip, deflate, br" {
+				t.Errorf("wrong Accept-Encoding %s", req.Header.Get("Accept-Encoding"))
+			}
+
+			header := make(http.Header)
+			header.Set("Content-Encoding", strings.TrimPrefix(encoding, "raw-"))
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewReader(body)),
+				Header:     header,
+			}
+		})
+
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		status, err := tools.FetchJSON("http://example.com/api", &decodedJSON, client)
+		if err != nil {
+			t.Errorf("encoding %q: unexpected error: %s", encoding, err)
+		}
+
+		if status != http.StatusOK {
+			t.Errorf("encoding %q: wrong status %d", encoding, status)
+		}
+
+		if decodedJSON.Foo != "bar" {
+			t.Errorf("encoding %q: expected bar, got %q", encoding, decodedJSON.Foo)
+		}
+	}
+
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusBadGateway,
+			Body:       io.NopCloser(strings.NewReader("upstream down")),
+			Header:     make(http.Header),
+		}
+	})
+
+	var decodedJSON any
+	if status, err := tools.FetchJSON("http://example.com/api", &decodedJSON, client); err == nil || status != http.StatusBadGateway {
+		t.Errorf("expected error for upstream failure, got status %d and %v", status, err)
+	}
+}
+
+func TestTools_CSRFToken(t *testing.T) {
+	var tools Tools
+
+	token, err := tools.GenerateCSRFToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(token) != 43 {
+		t.Errorf("expected 43 character token, got %d", len(token))
+	}
+
+	other, _ := tools.GenerateCSRFToken()
+	if token == other {
+		t.Error("tokens should be unique")
+	}
+
+	if !tools.ValidateCSRFToken(token, token) {
+		t.Error("matching tokens should validate")
+	}
+
+	if tools.ValidateCSRFToken(token, other) {
+		t.Error("different tokens should not validate")
+	}
+
+	if tools.ValidateCSRFToken("", "") {
+		t.Error("empty tokens should not validate")
+	}
+}
+
+func TestTools_UploadFilesCopyBufferSize(t *testing.T) {
+	img := readTestImage(t)
+
+	var tools Tools
+	tools.CopyBufferSize = 1024
+
+	for range 2 {
+		request := newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+
+		uploadedFiles, err := tools.UploadFiles(request, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if uploadedFiles[0].FileSize != int64(len(img)) {
+			t.Errorf("expected %d bytes copied, got %d", len(img), uploadedFiles[0].FileSize)
+		}
+	}
+}
+
+func benchmarkUploadFiles(b *testing.B, bufferSize int) {
+	img, err := os.ReadFile("./testdata/cat.jpg")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	content := make([]byte, 64*1024*1024)
+	copy(content, img)
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "large.jpg")
+	part.Write(content)
+	writer.Close()
+
+	dir := b.TempDir()
+
+	var tools Tools
+	tools.CopyBufferSize = bufferSize
+	tools.MaxFileSize = 2 * len(content)
+
+	b.SetBytes(int64(len(content)))
+
+	for b.Loop() {
+		request := httptest.NewRequest("POST", "/", bytes.NewReader(body.Bytes()))
+		request.Header.Add("Content-Type", writer.FormDataContentType())
+
+		uploadedFiles, err := tools.UploadFiles(request, dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		os.Remove(dir + "/" + uploadedFiles[0].NewFileName)
+	}
+}
+
+func BenchmarkTools_UploadFilesDefaultBuffer(b *testing.B) {
+	benchmarkUploadFiles(b, 0)
+}
+
+func BenchmarkTools_UploadFiles1MBBuffer(b *testing.B) {
+	benchmarkUploadFiles(b, 1024*1024)
+}
+
+func TestTools_ProxyJSON(t *testing.T) {
+	var tools Tools
+
+	var forwarded string
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		body, _ := io.ReadAll(req.Body)
+		forwarded = string(body)
+
+		header := make(http.Header)
+		header.Set("Content-Type", "application/json")
+
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(strings.NewReader(`{"queued": true}`)),
+			Header:     header,
+		}
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"foo": "bar"}`))
+
+	if err := tools.ProxyJSON(rr, req, "http://upstream.example.com/jobs", client); err != nil {
+		t.Fatal(err)
+	}
+
+	if forwarded != `{"foo": "bar"}` {
+		t.Errorf("wrong body forwarded: %s", forwarded)
+	}
+
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("upstream status not relayed, got %d", rr.Code)
+	}
+
+	if rr.Body.String() != `{"queued": true}` {
+		t.Errorf("upstream body not relayed, got %s", rr.Body.String())
+	}
+
+	forwarded = ""
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"foo": }`))
+
+	if err := tools.ProxyJSON(httptest.NewRecorder(), req, "http://upstream.example.com/jobs", client); err == nil {
+		t.Error("expected error for malformed JSON")
+	}
+
+	if forwarded != "" {
+		t.Error("malformed JSON should not be forwarded")
+	}
+}
+
+var downloadNameTests = []struct {
+	name     string
+	input    string
+	expected string
+}{
+	{name: "plain", input: "report.pdf", expected: "report.pdf"},
+	{name: "separators", input: "a,b;c.txt", expected: "a_b_c.txt"},
+	{name: "quotes and slashes", input: `my "best"/file\name.txt`, expected: "my _best__file_name.txt"},
+	{name: "whitespace collapsed", input: "  annual \t\n report  .pdf ", expected: "annual report .pdf"},
+	{name: "control characters", input: "bad\x00name\x7f.txt", expected: "bad_name_.txt"},
+	{name: "unicode kept", input: "résumé.pdf", expected: "résumé.pdf"},
+	{name: "empty", input: "   ", expected: "download"},
+	{name: "dots only", input: "..", expected: "download"},
+}
+
+func TestTools_SanitizeDownloadName(t *testing.T) {
+	var tools Tools
+
+	for _, test := range downloadNameTests {
+		if sanitized := tools.SanitizeDownloadName(test.input); sanitized != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, sanitized)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	tools.DownloadStaticFile(rr, httptest.NewRequest("GET", "/", nil), "./testdata", "cat.jpg", "cat;1.jpg")
+
+	if rr.Header().Get("Content-Disposition") != `attachment; filename="cat_1.jpg"` {
+		t.Errorf("download name not sanitized: %s", rr.Header().Get("Content-Disposition"))
+	}
+}
+
+var paginateTests = []struct {
+	name     string
+	page     int
+	perPage  int
+	expected []int
+}{
+	{name: "first page", page: 1, perPage: 3, expected: []int{1, 2, 3}},
+	{name: "middle page", page: 2, perPage: 3, expected: []int{4, 5, 6}},
+	{name: "partial last page", page: 4, perPage: 3, expected: []int{10}},
+	{name: "page past the end", page: 5, perPage: 3, expected: []int{}},
+	{name: "far past the end", page: 1000, perPage: 3, expected: []int{}},
+	{name: "page below one", page: 0, perPage: 3, expected: []int{1, 2, 3}},
+	{name: "zero per page", page: 1, perPage: 0, expected: []int{}},
+}
+
+func TestTools_Paginate(t *testing.T) {
+	var tools Tools
+
+	items := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	for _, test := range paginateTests {
+		page, total := tools.Paginate(items, test.page, test.perPage)
+
+		if total != len(items) {
+			t.Errorf("%s: expected total %d, got %d", test.name, len(items), total)
+		}
+
+		got, ok := page.([]int)
+		if !ok {
+			t.Errorf("%s: expected []int, got %T", test.name, page)
+			continue
+		}
+
+		if !slices.Equal(got, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+
+	if page, total := tools.Paginate("not a slice", 1, 10); page != nil || total != 0 {
+		t.Errorf("expected nil and 0 for non-slice input, got %v and %d", page, total)
+	}
+}
+
+var cookieTests = []struct {
+	name          string
+	options       CookieOptions
+	contains      []string
+	missing       []string
+	errorExpected bool
+}{
+	{
+		name:     "secure defaults",
+		options:  CookieOptions{Name: "session", Value: "abc"},
+		contains: []string{"session=abc", "Path=/", "HttpOnly", "Secure", "SameSite=Lax"},
+	},
+	{
+		name:     "strict same site",
+		options:  CookieOptions{Name: "session", Value: "abc", SameSite: http.SameSiteStrictMode},
+		contains: []string{"SameSite=Strict", "HttpOnly", "Secure"},
+	},
+	{
+		name:     "script access allowed",
+		options:  CookieOptions{Name: "theme", Value: "dark", AllowScriptAccess: true},
+		contains: []string{"theme=dark", "Secure"},
+		missing:  []string{"HttpOnly"},
+	},
+	{
+		name:     "insecure for local development",
+		options:  CookieOptions{Name: "session", Value: "abc", Insecure: true, Path: "/app"},
+		contains: []string{"Path=/app", "HttpOnly"},
+		missing:  []string{"Secure"},
+	},
+	{
+		name:          "same site none without secure",
+		options:       CookieOptions{Name: "session", SameSite: http.SameSiteNoneMode, Insecure: true},
+		errorExpected: true,
+	},
+	{
+		name:          "empty name",
+		options:       CookieOptions{Value: "abc"},
+		errorExpected: true,
+	},
+	{
+		name:          "invalid name",
+		options:       CookieOptions{Name: "bad name", Value: "abc"},
+		errorExpected: true,
+	},
+}
+
+func TestTools_SetCookie(t *testing.T) {
+	var tools Tools
+
+	for _, test := range cookieTests {
+		rr := httptest.NewRecorder()
+
+		err := tools.SetCookie(rr, test.options)
+		if test.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, none received", test.name)
+			}
+			if rr.Header().Get("Set-Cookie") != "" {
+				t.Errorf("%s: cookie set despite error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		header := rr.Header().Get("Set-Cookie")
+		attrs := strings.Split(header, "; ")
+
+		for _, want := range test.contains {
+			if !slices.Contains(attrs, want) {
+				t.Errorf("%s: expected %q in %q", test.name, want, header)
+			}
+		}
+
+		for _, unwanted := range test.missing {
+			if slices.Contains(attrs, unwanted) {
+				t.Errorf("%s: did not expect %q in %q", test.name, unwanted, header)
+			}
+		}
+	}
+}
+
+func TestTools_ClearCookie(t *testing.T) {
+	var tools Tools
+
+	rr := httptest.NewRecorder()
+	if err := tools.ClearCookie(rr, "session"); err != nil {
+		t.Fatal(err)
+	}
+
+	header := rr.Header().Get("Set-Cookie")
+	for _, want := range []string{"session=", "Max-Age=0", "HttpOnly", "Secure", "SameSite=Lax"} {
+		if !strings.Contains(header, want) {
+			t.Errorf("expected %q in %q", want, header)
+		}
+	}
+}
+
+var passwordStrengthTests = []struct {
+	name     string
+	password string
+	minScore int
+	maxScore int
+	reason   string
+}{
+	{name: "empty", password: "", minScore: 0, maxScore: 0, reason: "at least 8 characters"},
+	{name: "short", password: "aB3$", minScore: 0, maxScore: 0, reason: "at least 8 characters"},
+	{name: "common", password: "Password1", minScore: 0, maxScore: 0, reason: "too common"},
+	{name: "single class", password: "abcdefghij", minScore: 0, maxScore: 2, reason: "should mix"},
+	{name: "repeated", password: "aaaaaaaaaaaaaaaa", minScore: 0, maxScore: 0, reason: "repeats"},
+	{name: "decent", password: "Blue-Kettle-42", minScore: 2, maxScore: 3},
+	{name: "strong", password: "t7#Qm!vZ2@pL9xW&", minScore: 4, maxScore: 4},
+}
+
+func TestTools_PasswordStrength(t *testing.T) {
+	var tools Tools
+
+	for _, test := range passwordStrengthTests {
+		score, reasons := tools.PasswordStrength(test.password)
+
+		if score < test.minScore || score > test.maxScore {
+			t.Errorf("%s: expected score between %d and %d, got %d", test.name, test.minScore, test.maxScore, score)
+		}
+
+		joined := strings.Join(reasons, "; ")
+		if test.reason != "" && !strings.Contains(joined, test.reason) {
+			t.Errorf("%s: expected reason containing %q, got %q", test.name, test.reason, joined)
+		}
+
+		if test.reason == "" && len(reasons) > 0 {
+			t.Errorf("%s: expected no reasons, got %q", test.name, joined)
+		}
+	}
+}
+
+func TestTools_MethodNotAllowed(t *testing.T) {
+	var tools Tools
+
+	rr := httptest.NewRecorder()
+	if err := tools.MethodNotAllowed(rr, "post", "OPTIONS", "POST"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", rr.Code)
+	}
+
+	if allow := rr.Header().Get("Allow"); allow != "POST, OPTIONS" {
+		t.Errorf("expected Allow header %q, got %q", "POST, OPTIONS", allow)
+	}
+
+	var payload JSONResponse
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if !payload.Error || payload.Message != "method not allowed" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+}
+
+var streamJSONArrayTests = []struct {
+	name          string
+	json          string
+	maxSize       int
+	expected      []string
+	errorExpected bool
+}{
+	{name: "objects", json: `[{"a":1}, {"b":2}, {"c":3}]`, expected: []string{`{"a":1}`, `{"b":2}`, `{"c":3}`}},
+	{name: "mixed values", json: `[1, "two", [3], null]`, expected: []string{`1`, `"two"`, `[3]`, `null`}},
+	{name: "empty array", json: `[]`},
+	{name: "not an array", json: `{"a":1}`, errorExpected: true},
+	{name: "empty body", json: ``, errorExpected: true},
+	{name: "truncated", json: `[{"a":1}, {"b":`, expected: []string{`{"a":1}`}, errorExpected: true},
+	{name: "trailing data", json: `[1] [2]`, expected: []string{`1`}, errorExpected: true},
+	{name: "element too large", json: `[1, "` + strings.Repeat("x", 100) + `"]`, maxSize: 50, expected: []string{`1`}, errorExpected: true},
+	{name: "huge element", json: `[1, "` + strings.Repeat("x", 100000) + `"]`, maxSize: 50, expected: []string{`1`}, errorExpected: true},
+}
+
+func TestTools_StreamJSONArray(t *testing.T) {
+	var tools Tools
+
+	for _, test := range streamJSONArrayTests {
+		tools.MaxJSONSize = test.maxSize
+
+		out := make(chan json.RawMessage)
+		errCh := make(chan error, 1)
+
+		go func() {
+			errCh <- tools.StreamJSONArray(strings.NewReader(test.json), out)
+		}()
+
+		var got []string
+		for element := range out {
+			got = append(got, string(element))
+		}
+
+		err := <-errCh
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if !slices.Equal(got, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+var slugifyLocaleTests = []struct {
+	name          string
+	s             string
+	lang          string
+	expected      string
+	errorExpected bool
+}{
+	{name: "turkish dotted capital", s: "İstanbul Rehberi", lang: "tr", expected: "istanbul-rehberi"},
+	{name: "turkish dotless capital", s: "ISPARTA ILI", lang: "tr", expected: "isparta-ili"},
+	{name: "accents folded", s: "Crème Brûlée", lang: "fr", expected: "creme-brulee"},
+	{name: "no language", s: "Hello World", lang: "", expected: "hello-world"},
+	{name: "invalid language", s: "Hello", lang: "not a tag!", errorExpected: true},
+	{name: "empty string", s: "", lang: "tr", errorExpected: true},
+}
+
+func TestTools_SlugifyLocale(t *testing.T) {
+	var tools Tools
+
+	for _, test := range slugifyLocaleTests {
+		slug, err := tools.SlugifyLocale(test.s, test.lang)
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if slug != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, slug)
+		}
+	}
+}
+
+type readRequestPayload struct {
+	Name string   `json:"name" form:"name"`
+	Age  int      `json:"age" form:"age"`
+	Tags []string `json:"tags" form:"tag"`
+}
+
+func TestTools_ReadRequest(t *testing.T) {
+	var tools Tools
+
+	expected := readRequestPayload{Name: "ann", Age: 42, Tags: []string{"a", "b"}}
+
+	multipartBody := new(bytes.Buffer)
+	writer := multipart.NewWriter(multipartBody)
+	writer.WriteField("name", "ann")
+	writer.WriteField("age", "42")
+	writer.WriteField("tag", "a")
+	writer.WriteField("tag", "b")
+	writer.Close()
+
+	requests := map[string]*http.Request{
+		"json":      httptest.NewRequest("POST", "/", strings.NewReader(`{"name":"ann","age":42,"tags":["a","b"]}`)),
+		"form":      httptest.NewRequest("POST", "/", strings.NewReader("name=ann&age=42&tag=a&tag=b")),
+		"multipart": httptest.NewRequest("POST", "/", multipartBody),
+	}
+	requests["json"].Header.Set("Content-Type", "application/json; charset=utf-8")
+	requests["form"].Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	requests["multipart"].Header.Set("Content-Type", writer.FormDataContentType())
+
+	for name, req := range requests {
+		var payload readRequestPayload
+		if err := tools.ReadRequest(httptest.NewRecorder(), req, &payload); err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+
+		if payload.Name != expected.Name || payload.Age != expected.Age || !slices.Equal(payload.Tags, expected.Tags) {
+			t.Errorf("%s: expected %+v, got %+v", name, expected, payload)
+		}
+	}
+
+	for _, contentType := range []string{"text/plain", "", "application/xml"} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("name=ann"))
+		req.Header.Set("Content-Type", contentType)
+
+		var payload readRequestPayload
+		if err := tools.ReadRequest(httptest.NewRecorder(), req, &payload); !errors.Is(err, ErrUnsupportedMediaType) {
+			t.Errorf("%q: expected ErrUnsupportedMediaType, got %v", contentType, err)
+		}
+	}
+
+	tools.MaxJSONSize = 10
+	req := httptest.NewRequest("POST", "/", strings.NewReader("name="+strings.Repeat("x", 100)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var payload readRequestPayload
+	if err := tools.ReadRequest(httptest.NewRecorder(), req, &payload); err == nil {
+		t.Error("expected error for oversized form body")
+	}
+}
+
+func TestTools_ResponseTransformer(t *testing.T) {
+	type user struct {
+		Name         string `json:"name"`
+		PasswordHash string `json:"password_hash,omitempty"`
+	}
+
+	var tools Tools
+	tools.AlwaysEnvelope = true
+	tools.ResponseTransformer = func(data any) any {
+		if u, ok := data.(user); ok {
+			u.PasswordHash = ""
+			return u
+		}
+		return data
+	}
+
+	rr := httptest.NewRecorder()
+	if err := tools.WriteJSON(rr, http.StatusOK, user{Name: "ann", PasswordHash: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := rr.Body.String(); body != `{"error":false,"message":"","data":{"name":"ann"}}` {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	rr = httptest.NewRecorder()
+	if err := tools.WriteJSONCanonical(rr, http.StatusOK, user{Name: "bob", PasswordHash: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(rr.Body.String(), "secret") {
+		t.Errorf("canonical output was not transformed: %s", rr.Body.String())
+	}
+
+	tools.ResponseTransformer = nil
+	rr = httptest.NewRecorder()
+	if err := tools.WriteJSON(rr, http.StatusOK, "plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := rr.Body.String(); body != `{"error":false,"message":"","data":"plain"}` {
+		t.Errorf("unexpected body without transformer %s", body)
+	}
+}
+
+func TestTools_MaxResponseSize(t *testing.T) {
+	var tools Tools
+	tools.MaxResponseSize = 20
+
+	rr := httptest.NewRecorder()
+	err := tools.WriteJSON(rr, http.StatusOK, []string{strings.Repeat("x", 50)})
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("expected ErrResponseTooLarge, got %v", err)
+	}
+
+	if rr.Body.Len() != 0 || rr.Header().Get("Content-Type") != "" {
+		t.Error("nothing should be written when the response is too large")
+	}
+
+	rr = httptest.NewRecorder()
+	if err := tools.WriteJSON(rr, http.StatusOK, []string{"small"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if rr.Body.String() != `["small"]` {
+		t.Errorf("unexpected body %s", rr.Body.String())
+	}
+}
+
+var healthTests = []struct {
+	name     string
+	checks   map[string]error
+	status   int
+	expected string
+}{
+	{name: "all ok", checks: map[string]error{"db": nil, "cache": nil}, status: http.StatusOK,
+		expected: `{"status":"ok","checks":{"cache":"ok","db":"ok"}}`},
+	{name: "one failing", checks: map[string]error{"db": errors.New("connection refused"), "cache": nil}, status: http.StatusServiceUnavailable,
+		expected: `{"status":"degraded","checks":{"cache":"ok","db":"connection refused"}}`},
+	{name: "no checks", checks: nil, status: http.StatusOK, expected: `{"status":"ok","checks":{}}`},
+}
+
+func TestTools_WriteHealth(t *testing.T) {
+	var tools Tools
+	tools.AlwaysEnvelope = true
+
+	for _, test := range healthTests {
+		rr := httptest.NewRecorder()
+		if err := tools.WriteHealth(rr, test.checks); err != nil {
+			t.Fatal(err)
+		}
+
+		if rr.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rr.Code)
+		}
+
+		if rr.Body.String() != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, rr.Body.String())
+		}
+
+		if rr.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: missing Cache-Control header", test.name)
+		}
+	}
+}
+
+var jsoncTests = []struct {
+	name          string
+	json          string
+	expected      string
+	errorExpected bool
+}{
+	{name: "plain json", json: `{"foo": "bar"}`, expected: "bar"},
+	{name: "line comment", json: "{\n// the value\n\"foo\": \"bar\" // trailing\n}", expected: "bar"},
+	{name: "block comment", json: `{/* multi
+line */ "foo": /* inline */ "bar"}`, expected: "bar"},
+	{name: "trailing comma", json: "{\"foo\": \"bar\",\n}", expected: "bar"},
+	{name: "trailing comma before comment", json: "{\"foo\": \"bar\", // done\n}", expected: "bar"},
+	{name: "comment markers in string", json: `{"foo": "http://example.com/*x*/"}`, expected: "http://example.com/*x*/"},
+	{name: "escaped quote in string", json: `{"foo": "say \"hi\", // not a comment"}`, expected: `say "hi", // not a comment`},
+	{name: "comma in string", json: `{"foo": ",}"}`, expected: ",}"},
+	{name: "unterminated comment", json: `{"foo": "bar"} /* oops`, errorExpected: true},
+	{name: "double comma", json: `{"foo": "bar",,}`, errorExpected: true},
+}
+
+func TestTools_ReadJSONC(t *testing.T) {
+	var tools Tools
+
+	for _, test := range jsoncTests {
+		var decoded struct {
+			Foo string `json:"foo"`
+		}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(test.json))
+
+		err := tools.ReadJSONC(httptest.NewRecorder(), req, &decoded)
+		if test.errorExpected && err == nil {
+			t.Errorf("%s: error expected, none received", test.name)
+		}
+
+		if !test.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if decoded.Foo != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, decoded.Foo)
+		}
+	}
+
+	var list struct {
+		Items []int `json:"items"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"items": [1, 2, 3,],}`))
+	if err := tools.ReadJSONC(httptest.NewRecorder(), req, &list); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(list.Items, []int{1, 2, 3}) {
+		t.Errorf("unexpected items %v", list.Items)
+	}
+}
+
+var (
+	pngSignature  = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+	jpegSignature = []byte{0xFF, 0xD8, 0xFF}
+	pdfSignature  = []byte("%PDF-")
+)
+
+var magicBytesTests = []struct {
+	name     string
+	head     []byte
+	expected bool
+}{
+	{name: "png", head: append(slices.Clone(pngSignature), 0, 0, 0, 13), expected: true},
+	{name: "truncated png", head: pngSignature[:6], expected: false},
+	{name: "png with bad byte", head: []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, 0}, expected: false},
+	{name: "jpeg", head: []byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 0x10}, expected: true},
+	{name: "pdf", head: []byte("%PDF-1.7\n"), expected: true},
+	{name: "pdf not at start", head: []byte(" %PDF-1.7\n"), expected: false},
+	{name: "text", head: []byte("hello world"), expected: false},
+	{name: "empty", head: nil, expected: false},
+}
+
+func TestTools_MatchMagicBytes(t *testing.T) {
+	var tools Tools
+
+	signatures := [][]byte{pngSignature, jpegSignature, pdfSignature}
+
+	for _, test := range magicBytesTests {
+		if got := tools.MatchMagicBytes(test.head, signatures); got != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, got)
+		}
+	}
+
+	if tools.MatchMagicBytes([]byte("anything"), [][]byte{{}}) {
+		t.Error("an empty signature should not match")
+	}
+
+	// configured signatures can be stricter than the sniffer, which
+	// accepts anything starting with %PDF- as a PDF
+	tools.FileSignatures = map[string][][]byte{"application/pdf": {[]byte("%PDF-1."), []byte("%PDF-2.")}}
+
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "doc.pdf", content: []byte("%PDF-junk\n%%EOF\n")})
+	if _, err := tools.UploadFiles(request, t.TempDir()); err == nil {
+		t.Error("expected upload without exact signature to be rejected")
+	}
+
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "doc.pdf", content: []byte("%PDF-1.4\n%%EOF\n")})
+	if _, err := tools.UploadFiles(request, t.TempDir()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+var mustReadJSONTests = []struct {
+	name           string
+	json           string
+	productionMode bool
+	ok             bool
+	status         int
+}{
+	{name: "valid", json: `{"foo": "bar"}`, ok: true, status: http.StatusOK},
+	{name: "bad json", json: `{"foo": }`, status: http.StatusBadRequest},
+	{name: "too large", json: `{"foo": "` + strings.Repeat("x", 100) + `"}`, status: http.StatusRequestEntityTooLarge},
+	{name: "too large in production", json: `{"foo": "` + strings.Repeat("x", 100) + `"}`, productionMode: true, status: http.StatusRequestEntityTooLarge},
+}
+
+func TestTools_MustReadJSON(t *testing.T) {
+	var tools Tools
+	tools.MaxJSONSize = 50
+
+	for _, test := range mustReadJSONTests {
+		tools.ProductionMode = test.productionMode
+
+		var decoded struct {
+			Foo string `json:"foo"`
+		}
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/", strings.NewReader(test.json))
+		req.ContentLength = -1
+
+		if ok := tools.MustReadJSON(rr, req, &decoded); ok != test.ok {
+			t.Errorf("%s: expected %t, got %t", test.name, test.ok, ok)
+		}
+
+		if rr.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rr.Code)
+		}
+
+		if !test.ok && !strings.Contains(rr.Body.String(), `"error":true`) {
+			t.Errorf("%s: expected JSON error body, got %s", test.name, rr.Body.String())
+		}
+	}
+}
+
+var dateRangeTests = []struct {
+	name          string
+	query         string
+	layout        string
+	from          string
+	to            string
+	errorExpected bool
+}{
+	{name: "valid range", query: "from=2024-01-01&to=2024-01-31", from: "2024-01-01", to: "2024-01-31"},
+	{name: "same day", query: "from=2024-01-01&to=2024-01-01", from: "2024-01-01", to: "2024-01-01"},
+	{name: "custom layout", query: "from=01/02/2024&to=01/03/2024", layout: "01/02/2006", from: "2024-01-02", to: "2024-01-03"},
+	{name: "reversed", query: "from=2024-02-01&to=2024-01-01", errorExpected: true},
+	{name: "missing from", query: "to=2024-01-01", errorExpected: true},
+	{name: "missing to", query: "from=2024-01-01", errorExpected: true},
+	{name: "invalid date", query: "from=2024-13-01&to=2024-01-01", errorExpected: true},
+	{name: "wrong layout", query: "from=01/02/2024&to=2024-01-03", errorExpected: true},
+}
+
+func TestTools_ReadDateRange(t *testing.T) {
+	var tools Tools
+
+	for _, test := range dateRangeTests {
+		from, to, err := tools.ReadDateRange(httptest.NewRequest("GET", "/?"+test.query, nil), test.layout)
+		if test.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, none received", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if got := from.Format(time.DateOnly); got != test.from {
+			t.Errorf("%s: expected from %s, got %s", test.name, test.from, got)
+		}
+
+		if got := to.Format(time.DateOnly); got != test.to {
+			t.Errorf("%s: expected to %s, got %s", test.name, test.to, got)
+		}
+	}
+}
+
+func TestTools_WriteJSONWithID(t *testing.T) {
+	var tools Tools
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+
+	rr := httptest.NewRecorder()
+	if err := tools.WriteJSONWithID(rr, req, http.StatusOK, map[string]int{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Header().Get("X-Request-ID") != "abc-123" {
+		t.Errorf("expected incoming request ID to be echoed, got %q", rr.Header().Get("X-Request-ID"))
+	}
+
+	if body := rr.Body.String(); body != `{"error":false,"message":"","data":{"n":1},"request_id":"abc-123"}` {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	for _, incoming := range []string{"", "bad id\r\nX-Injected: 1", strings.Repeat("a", 200)} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", incoming)
+
+		rr := httptest.NewRecorder()
+		if err := tools.WriteJSONWithID(rr, req, http.StatusCreated, JSONResponse{Message: "created"}); err != nil {
+			t.Fatal(err)
+		}
+
+		id := rr.Header().Get("X-Request-ID")
+		if len(id) != 32 || id == incoming {
+			t.Errorf("expected generated request ID for %q, got %q", incoming, id)
+		}
+
+		var payload JSONResponse
+		if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+
+		if payload.RequestID != id || payload.Message != "created" {
+			t.Errorf("unexpected payload %+v", payload)
+		}
+	}
+}
+
+type testFieldError struct {
+	field, tag string
+}
+
+func (e testFieldError) Field() string { return e.field }
+func (e testFieldError) Error() string { return e.field + " failed on the " + e.tag + " rule" }
+
+type testValidationErrors []testFieldError
+
+func (ve testValidationErrors) Error() string { return "validation failed" }
+
+func TestTools_ErrorJSONFromValidation(t *testing.T) {
+	var tools Tools
+
+	err := testValidationErrors{{"Email", "email"}, {"Age", "min"}, {"Email", "required"}}
+
+	rr := httptest.NewRecorder()
+	if err := tools.ErrorJSONFromValidation(rr, err, http.StatusUnprocessableEntity); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422, got %d", rr.Code)
+	}
+
+	expected := `{"error":true,"message":"validation failed","errors":{"Age":"Age failed on the min rule","Email":"Email failed on the email rule"}}`
+	if rr.Body.String() != expected {
+		t.Errorf("expected %s, got %s", expected, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	if err := tools.ErrorJSONFromValidation(rr, errors.New("plain failure")); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusBadRequest || rr.Body.String() != `{"error":true,"message":"plain failure"}` {
+		t.Errorf("expected plain error response, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestTools_EnvelopeFunc(t *testing.T) {
+	var tools Tools
+	tools.EnvelopeFunc = func(resp JSONResponse) any {
+		return struct {
+			Success      bool   `json:"success"`
+			ErrorMessage string `json:"error_message,omitempty"`
+			Result       any    `json:"result,omitempty"`
+		}{Success: !resp.Error, ErrorMessage: resp.Message, Result: resp.Data}
+	}
+
+	rr := httptest.NewRecorder()
+	if err := tools.ErrorJSON(rr, errors.New("bad input")); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := rr.Body.String(); body != `{"success":false,"error_message":"bad input"}` {
+		t.Errorf("unexpected error body %s", body)
+	}
+
+	rr = httptest.NewRecorder()
+	if err := tools.WriteJSON(rr, http.StatusOK, []int{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := rr.Body.String(); body != `[1,2]` {
+		t.Errorf("plain data should not be enveloped without AlwaysEnvelope, got %s", body)
+	}
+
+	tools.AlwaysEnvelope = true
+
+	rr = httptest.NewRecorder()
+	if err := tools.WriteJSON(rr, http.StatusOK, []int{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := rr.Body.String(); body != `{"success":true,"result":[1,2]}` {
+		t.Errorf("unexpected enveloped body %s", body)
+	}
+
+	rr = httptest.NewRecorder()
+	if err := tools.ErrorJSONFromValidation(rr, testValidationErrors{{"Email", "email"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"success":false,"error_message":"validation failed","result":{"Email":"Email failed on the email rule"}}`
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("expected validation errors in the envelope %s, got %s", expected, body)
+	}
+}
+
+type arrayItem struct {
+	Name string `json:"name"`
+	Qty  int    `json:"qty"`
+}
+
+func TestTools_ReadJSONArray(t *testing.T) {
+	var tools Tools
+
+	body := `[{"name": "a", "qty": 1}, {"name": "b", "qty": "two"}, {"name": "c", "qty": 3}, {"nmae": "d"}]`
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+
+	results, errs := tools.ReadJSONArray(httptest.NewRecorder(), req, func() any { return &arrayItem{} })
+
+	if len(results) != 2 || results[0].(*arrayItem).Name != "a" || results[1].(*arrayItem).Name != "c" {
+		t.Errorf("unexpected results %v", results)
+	}
+
+	var indexes []int
+	for _, err := range errs {
+		var itemErr *ItemError
+		if !errors.As(err, &itemErr) {
+			t.Fatalf("expected *ItemError, got %v", err)
+		}
+		indexes = append(indexes, itemErr.Index)
+	}
+
+	if !slices.Equal(indexes, []int{1, 3}) {
+		t.Errorf("expected errors for items 1 and 3, got %v", indexes)
+	}
+
+	for _, bad := range []string{`{"name": "a"}`, `[{"name": "a"}, {"name": `, ``, `[] []`} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(bad))
+
+		_, errs := tools.ReadJSONArray(httptest.NewRecorder(), req, func() any { return &arrayItem{} })
+		if len(errs) != 1 {
+			t.Errorf("%q: expected one error, got %v", bad, errs)
+			continue
+		}
+
+		var itemErr *ItemError
+		if errors.As(errs[0], &itemErr) {
+			t.Errorf("%q: expected an array level error, got %v", bad, errs[0])
+		}
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader("\ufeff"+`[{"name": "a", "qty": 1}]`))
+
+	results, errs = tools.ReadJSONArray(httptest.NewRecorder(), req, func() any { return &arrayItem{} })
+	if len(errs) != 0 || len(results) != 1 {
+		t.Errorf("expected a BOM-prefixed array to decode, got %v, %v", results, errs)
+	}
+}
+
+func TestTools_SignedURL(t *testing.T) {
+	var tools Tools
+
+	signed, err := tools.SignedURL("https://files.example.com/download?lang=en", "reports/q1.pdf", "s3cret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Query().Get("lang") != "en" {
+		t.Error("existing query parameters should be kept")
+	}
+
+	fileName, err := tools.VerifySignedURL(httptest.NewRequest("GET", signed, nil), "s3cret")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if fileName != "reports/q1.pdf" {
+		t.Errorf("expected reports/q1.pdf, got %s", fileName)
+	}
+
+	tampered := map[string]func(url.Values){
+		"other file":    func(q url.Values) { q.Set("file", "reports/q2.pdf") },
+		"later expiry":  func(q url.Values) { q.Set("expires", "99999999999") },
+		"bad signature": func(q url.Values) { q.Set("signature", "AAAA") },
+		"no signature":  func(q url.Values) { q.Del("signature") },
+	}
+
+	for name, tamper := range tampered {
+		q := u.Query()
+		tamper(q)
+
+		req := httptest.NewRequest("GET", "https://files.example.com/download?"+q.Encode(), nil)
+		if _, err := tools.VerifySignedURL(req, "s3cret"); err == nil {
+			t.Errorf("%s: expected verification to fail", name)
+		}
+	}
+
+	if _, err := tools.VerifySignedURL(httptest.NewRequest("GET", signed, nil), "other secret"); err == nil {
+		t.Error("expected verification with the wrong secret to fail")
+	}
+
+	otherPath := "https://files.example.com/admin/delete?" + u.RawQuery
+	if _, err := tools.VerifySignedURL(httptest.NewRequest("GET", otherPath, nil), "s3cret"); err == nil {
+		t.Error("expected a signature for another path to fail")
+	}
+
+	expired, err := tools.SignedURL("https://files.example.com/download", "q1.pdf", "s3cret", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tools.VerifySignedURL(httptest.NewRequest("GET", expired, nil), "s3cret"); err == nil || err.Error() != "URL has expired" {
+		t.Errorf("expected expired error, got %v", err)
+	}
+
+	root, err := tools.SignedURL("https://files.example.com", "q1.pdf", "s3cret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tools.VerifySignedURL(httptest.NewRequest("GET", root, nil), "s3cret"); err != nil {
+		t.Errorf("expected a URL without a path to verify on /, got %v", err)
+	}
+
+	if signed, err := tools.SignedURL("https://files.example.com/%zz", "q1.pdf", "s3cret", time.Hour); err == nil || signed != "" {
+		t.Errorf("expected an error for an unparseable base URL, got %q", signed)
+	}
+}
+
+var jsonRangeTests = []struct {
+	name     string
+	json     string
+	defaults bool
+	expected string
+}{
+	{name: "in range", json: `{"per_page": 50, "ratio": 0.5}`},
+	{name: "at bounds", json: `{"per_page": 100, "ratio": 1, "offset": 0}`},
+	{name: "below min", json: `{"per_page": 0}`, expected: "field per_page must be at least 1"},
+	{name: "above max", json: `{"per_page": 101}`, expected: "field per_page must be at most 100"},
+	{name: "float above max", json: `{"per_page": 10, "ratio": 1.5}`, expected: "field ratio must be at most 1"},
+	{name: "negative offset", json: `{"per_page": 10, "offset": -1}`, expected: "field offset must be at least 0"},
+	{name: "nested", json: `{"per_page": 10, "window": {"days": 400}}`, expected: "field days must be at most 366"},
+	{name: "zero with default", json: `{"per_page": 0}`, expected: "field per_page must be at least 1"},
+	{name: "omitted with default", json: `{}`, expected: "field per_page must be at least 1"},
+	{name: "zero filled by default", json: `{"per_page": 0}`, defaults: true},
+	{name: "omitted filled by default", json: `{}`, defaults: true},
+	{name: "above max with defaults", json: `{"per_page": 101}`, defaults: true, expected: "field per_page must be at most 100"},
+	{name: "non-numeric tagged fields", json: `{"per_page": 10, "name": "ab", "tags": []}`},
+	{name: "malformed bound", json: `{"per_page": 10, "count": -5}`},
+}
+
+type rangePayload struct {
+	PerPage int      `json:"per_page" min:"1" max:"100" default:"20"`
+	Ratio   float64  `json:"ratio" max:"1"`
+	Offset  int      `json:"offset" min:"0"`
+	Name    string   `json:"name" min:"3" max:"40"`
+	Tags    []string `json:"tags" min:"1"`
+	Count   int      `json:"count" min:"one"`
+	Window  *struct {
+		Days int `json:"days" min:"1" max:"366"`
+	} `json:"window"`
+}
+
+func TestTools_ReadJSONRanges(t *testing.T) {
+	var tools Tools
+
+	for _, test := range jsonRangeTests {
+		var payload rangePayload
+
+		read := tools.ReadJSON
+		if test.defaults {
+			read = tools.ReadJSONWithDefaults
+		}
+
+		err := read(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(test.json)), &payload)
+		if test.expected == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if test.expected != "" && (err == nil || err.Error() != test.expected) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.expected, err)
+		}
+	}
+
+	var withDefault struct {
+		PerPage int `json:"per_page" default:"20" min:"1" max:"100"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{}`))
+	if err := tools.ReadJSONWithDefaults(httptest.NewRecorder(), req, &withDefault); err != nil {
+		t.Errorf("omitted field with a default should pass: %s", err)
+	}
+
+	var badDefault struct {
+		PerPage int `json:"per_page" default:"500" min:"1" max:"100"`
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{}`))
+	if err := tools.ReadJSONWithDefaults(httptest.NewRecorder(), req, &badDefault); err == nil {
+		t.Error("expected out of range default to be rejected")
+	}
+}
+
+func TestTools_RecoverMiddleware(t *testing.T) {
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	var debugTests = []struct {
+		name           string
+		debug          bool
+		productionMode bool
+		message        string
+		stack          bool
+	}{
+		{name: "debug", debug: true, message: "panic: boom", stack: true},
+		{name: "default", message: "internal server error"},
+		{name: "debug in production", debug: true, productionMode: true, message: "internal server error"},
+	}
+
+	for _, test := range debugTests {
+		var tools Tools
+		tools.Debug = test.debug
+		tools.ProductionMode = test.productionMode
+
+		logger := &testLogger{}
+		tools.Logger = logger
+
+		rr := httptest.NewRecorder()
+		tools.RecoverMiddleware(panicking).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("%s: expected status 500, got %d", test.name, rr.Code)
+		}
+
+		var payload JSONResponse
+		if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+
+		if payload.Message != test.message {
+			t.Errorf("%s: expected message %q, got %q", test.name, test.message, payload.Message)
+		}
+
+		if hasStack := strings.Contains(payload.Stack, "TestTools_RecoverMiddleware"); hasStack != test.stack {
+			t.Errorf("%s: expected stack trace %t, got %q", test.name, test.stack, payload.Stack)
+		}
+
+		if len(logger.messages) != 1 {
+			t.Errorf("%s: expected the panic to be logged", test.name)
+		}
+	}
+
+	var tools Tools
+	rr := httptest.NewRecorder()
+	tools.RecoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	if rr.Code != http.StatusTeapot {
+		t.Errorf("handler without panic should be untouched, got %d", rr.Code)
+	}
+}
+
+func testZip(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	f, err := zw.Create("payload.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestTools_CheckPolyglot(t *testing.T) {
+	var tools Tools
+
+	img := readTestImage(t)
+
+	var polyglotTests = []struct {
+		name     string
+		content  []byte
+		expected bool
+	}{
+		{name: "clean jpeg", content: img, expected: false},
+		{name: "script comment", content: append(slices.Clone(img), []byte("<SCRIPT>alert(1)</script>")...), expected: true},
+		{name: "php payload", content: append(slices.Clone(img[:100]), []byte("<?php system($_GET['c']); ?>")...), expected: true},
+		{name: "appended zip", content: append(slices.Clone(img), testZip(t)...), expected: true},
+		{name: "stray zip signature", content: append(slices.Clone(img), []byte("PK\x03\x04\x14\x00")...), expected: false},
+		{name: "lowercase zip signature", content: append(append(slices.Clone(img), []byte("pk\x03\x04")...), []byte("pk\x05\x06")...), expected: false},
+		{name: "zip end record too early", content: append(append([]byte("PK\x05\x06PK\x03\x04"), img...), bytes.Repeat([]byte{0}, zipEndSearchSize)...), expected: false},
+		{name: "marker across chunk boundary", content: append(bytes.Repeat([]byte{0}, 32*1024-3), []byte("<html>")...), expected: true},
+	}
+
+	for _, test := range polyglotTests {
+		found, err := tools.CheckPolyglot(bytes.NewReader(test.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if found != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, found)
+		}
+	}
+
+	tools.RejectPolyglots = true
+
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: polyglotTests[1].content})
+	if _, err := tools.UploadFiles(request, t.TempDir()); err == nil {
+		t.Error("expected polyglot image to be rejected")
+	}
+
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+	if _, err := tools.UploadFiles(request, t.TempDir()); err != nil {
+		t.Errorf("unexpected error for clean image: %s", err)
+	}
+}
+
+var pageBoundsTests = []struct {
+	name       string
+	page       int
+	perPage    int
+	total      int
+	offset     int
+	limit      int
+	totalPages int
+}{
+	{name: "first page", page: 1, perPage: 10, total: 95, offset: 0, limit: 10, totalPages: 10},
+	{name: "last partial page", page: 10, perPage: 10, total: 95, offset: 90, limit: 5, totalPages: 10},
+	{name: "exact multiple", page: 2, perPage: 5, total: 10, offset: 5, limit: 5, totalPages: 2},
+	{name: "beyond last page", page: 11, perPage: 10, total: 95, offset: 95, limit: 0, totalPages: 10},
+	{name: "page zero", page: 0, perPage: 10, total: 95, offset: 0, limit: 10, totalPages: 10},
+	{name: "negative page", page: -3, perPage: 10, total: 95, offset: 0, limit: 10, totalPages: 10},
+	{name: "zero per page", page: 1, perPage: 0, total: 95, offset: 0, limit: 0, totalPages: 0},
+	{name: "negative per page", page: 1, perPage: -5, total: 95, offset: 0, limit: 0, totalPages: 0},
+	{name: "no items", page: 1, perPage: 10, total: 0, offset: 0, limit: 0, totalPages: 0},
+	{name: "negative total", page: 1, perPage: 10, total: -1, offset: 0, limit: 0, totalPages: 0},
+	{name: "huge page", page: math.MaxInt, perPage: 1000, total: 95, offset: 95, limit: 0, totalPages: 1},
+	{name: "huge per page", page: 2, perPage: math.MaxInt, total: 95, offset: 95, limit: 0, totalPages: 1},
+	{name: "huge total", page: 3, perPage: math.MaxInt / 2, total: math.MaxInt, offset: math.MaxInt - 1, limit: 1, totalPages: 3},
+}
+
+func TestTools_PageBounds(t *testing.T) {
+	var tools Tools
+
+	for _, test := range pageBoundsTests {
+		offset, limit, totalPages := tools.PageBounds(test.page, test.perPage, test.total)
+
+		if offset != test.offset || limit != test.limit || totalPages != test.totalPages {
+			t.Errorf("%s: expected (%d, %d, %d), got (%d, %d, %d)",
+				test.name, test.offset, test.limit, test.totalPages, offset, limit, totalPages)
+		}
+	}
+}
+
+type createUserV1 struct {
+	Name string `json:"name"`
+}
+
+type createUserV2 struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+func TestTools_ReadVersionedJSON(t *testing.T) {
+	var tools Tools
+
+	versions := map[string]func() any{
+		"1": func() any { return &createUserV1{} },
+		"2": func() any { return &createUserV2{} },
+	}
+
+	var versionTests = []struct {
+		name          string
+		header        string
+		body          string
+		version       string
+		errorExpected bool
+	}{
+		{name: "body version 1", body: `{"_version": "1", "name": "Ann Lee"}`, version: "1"},
+		{name: "body version 2", body: `{"first_name": "Ann", "last_name": "Lee", "_version": "2"}`, version: "2"},
+		{name: "header version", header: "2", body: `{"first_name": "Ann", "last_name": "Lee"}`, version: "2"},
+		{name: "body version after BOM", body: "\ufeff" + `{"_version": "1", "name": "Ann Lee"}`, version: "1"},
+		{name: "header wins over body", header: "1", body: `{"_version": "2", "name": "Ann Lee"}`, version: "1"},
+		{name: "fields of another version", body: `{"_version": "1", "first_name": "Ann"}`, errorExpected: true},
+		{name: "unknown version", body: `{"_version": "3", "name": "Ann"}`, errorExpected: true},
+		{name: "missing version", body: `{"name": "Ann"}`, errorExpected: true},
+		{name: "numeric version", body: `{"_version": 1, "name": "Ann"}`, errorExpected: true},
+	}
+
+	for _, test := range versionTests {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+		if test.header != "" {
+			req.Header.Set(ReadJSONVersionHeader, test.header)
+		}
+
+		data, version, err := tools.ReadVersionedJSON(httptest.NewRecorder(), req, versions)
+		if test.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, none received", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if version != test.version {
+			t.Errorf("%s: expected version %s, got %s", test.name, test.version, version)
+		}
+
+		switch v := data.(type) {
+		case *createUserV1:
+			if version != "1" || v.Name != "Ann Lee" {
+				t.Errorf("%s: unexpected v1 payload %+v", test.name, v)
+			}
+		case *createUserV2:
+			if version != "2" || v.FirstName != "Ann" || v.LastName != "Lee" {
+				t.Errorf("%s: unexpected v2 payload %+v", test.name, v)
+			}
+		default:
+			t.Errorf("%s: unexpected type %T", test.name, data)
+		}
+	}
+}
+
+var addVaryTests = []struct {
+	name     string
+	existing []string
+	add      []string
+	expected string
+}{
+	{name: "empty", add: []string{"Accept"}, expected: "Accept"},
+	{name: "several", add: []string{"Accept", "accept-language"}, expected: "Accept, Accept-Language"},
+	{name: "dedupe existing", existing: []string{"Accept-Encoding"}, add: []string{"accept-encoding", "Accept"}, expected: "Accept-Encoding, Accept"},
+	{name: "dedupe arguments", add: []string{"Accept", "Accept"}, expected: "Accept"},
+	{name: "merge multiple values", existing: []string{"Origin", "Accept, Cookie"}, add: []string{"Cookie"}, expected: "Origin"},
+	{name: "star wins", existing: []string{"Accept"}, add: []string{"*"}, expected: "*"},
+	{name: "star already set", existing: []string{"*"}, add: []string{"Accept"}, expected: "*"},
+}
+
+func TestTools_AddVary(t *testing.T) {
+	var tools Tools
+
+	for _, test := range addVaryTests {
+		rr := httptest.NewRecorder()
+		for _, v := range test.existing {
+			rr.Header().Add("Vary", v)
+		}
+
+		tools.AddVary(rr, test.add...)
+
+		if got := rr.Header().Get("Vary"); got != test.expected {
+			t.Errorf("%s: expected Vary %q, got %q", test.name, test.expected, got)
+		}
+	}
+}
+
+var boolParamTests = []struct {
+	query    string
+	def      bool
+	expected bool
+}{
+	{query: "active=true", expected: true},
+	{query: "active=TRUE", expected: true},
+	{query: "active=1", expected: true},
+	{query: "active=yes", expected: true},
+	{query: "active=Y", expected: true},
+	{query: "active=on", expected: true},
+	{query: "active=t", expected: true},
+	{query: "active=%20On%20", expected: true},
+	{query: "active=false", def: true, expected: false},
+	{query: "active=False", def: true, expected: false},
+	{query: "active=0", def: true, expected: false},
+	{query: "active=no", def: true, expected: false},
+	{query: "active=N", def: true, expected: false},
+	{query: "active=off", def: true, expected: false},
+	{query: "active=f", def: true, expected: false},
+	{query: "", expected: false},
+	{query: "", def: true, expected: true},
+	{query: "active=", def: true, expected: true},
+	{query: "active=maybe", def: true, expected: true},
+	{query: "active=2", expected: false},
+	{query: "other=true", expected: false},
+}
+
+func TestTools_ReadBoolParam(t *testing.T) {
+	var tools Tools
+
+	for _, test := range boolParamTests {
+		req := httptest.NewRequest("GET", "/items?"+test.query, nil)
+
+		if got := tools.ReadBoolParam(req, "active", test.def); got != test.expected {
+			t.Errorf("%q (default %t): expected %t, got %t", test.query, test.def, test.expected, got)
+		}
+	}
+}
+
+func TestTools_UploadFilesChecksum(t *testing.T) {
+	img := readTestImage(t)
+	sum := sha256.Sum256(img)
+
+	var tools Tools
+	tools.ChecksumUploads = true
+
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+
+	uploadedFiles, err := tools.UploadFiles(request, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFiles[0].Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("wrong checksum %s", uploadedFiles[0].Checksum)
+	}
+
+	tools.ChecksumUploads = false
+
+	request = newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+
+	uploadedFiles, err = tools.UploadFiles(request, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFiles[0].Checksum != "" {
+		t.Errorf("checksum computed without ChecksumUploads: %s", uploadedFiles[0].Checksum)
+	}
+}
+
+func TestTools_WriteUploadManifest(t *testing.T) {
+	var tools Tools
+
+	files := []*UploadedFile{
+		{NewFileName: "a1b2.jpg", OriginalFileName: "cat.jpg", FileSize: 1024, Checksum: "abc123"},
+		nil,
+		{NewFileName: "c3d4.png", OriginalFileName: "dog.png", FileSize: 2048},
+	}
+
+	var buf bytes.Buffer
+	if err := tools.WriteUploadManifest(&buf, files); err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest struct {
+		Files []map[string]any `json:"files"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Files) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(manifest.Files))
+	}
+
+	first := manifest.Files[0]
+	if first["original_name"] != "cat.jpg" || first["stored_name"] != "a1b2.jpg" || first["size"] != float64(1024) || first["checksum"] != "abc123" {
+		t.Errorf("unexpected first entry %v", first)
+	}
+
+	if _, ok := manifest.Files[1]["checksum"]; ok {
+		t.Errorf("checksum written for file without one: %v", manifest.Files[1])
+	}
+
+	buf.Reset()
+	if err := tools.WriteUploadManifest(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), `"files": []`) {
+		t.Errorf("expected empty file list, got %s", buf.String())
+	}
+}
+
+func TestTools_SharedHTTPClient(t *testing.T) {
+	var tools Tools
+	tools.HTTPTimeout = 5 * time.Second
+	tools.HTTPMaxIdleConns = 50
+	tools.HTTPMaxIdleConnsPerHost = 25
+	tools.HTTPIdleConnTimeout = time.Minute
+
+	client := tools.httpClient()
+	if client != tools.httpClient() {
+		t.Fatal("expected the same client on every call")
+	}
+
+	if client.Timeout != 5*time.Second {
+		t.Errorf("expected timeout 5s, got %s", client.Timeout)
+	}
+
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("unexpected transport %T", client.Transport)
+	}
+
+	if transport.MaxIdleConns != 50 || transport.MaxIdleConnsPerHost != 25 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("transport settings not applied: %d, %d, %s", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS12 {
+		t.Error("expected TLS 1.2 minimum")
+	}
+
+	custom := &http.Client{}
+	if tools.httpClient(custom) != custom {
+		t.Error("expected the passed client to be used")
+	}
+
+	var defaults Tools
+	if got := defaults.httpClient().Transport.(*http.Transport).MaxIdleConnsPerHost; got != defaultMaxIdleConnsPerHost {
+		t.Errorf("expected %d idle connections per host by default, got %d", defaultMaxIdleConnsPerHost, got)
+	}
+}
+
+func TestTools_PushJSONToRemoteReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	var tools Tools
+
+	for range 5 {
+		if _, _, err := tools.PushJSONToRemote(server.URL, map[string]string{"foo": "bar"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Errorf("expected a single pooled connection, got %d", n)
+	}
+}
+
+const svgRoot = `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"`
+
+var sanitizeSVGTests = []struct {
+	name          string
+	input         string
+	expected      string
+	errorExpected bool
+}{
+	{
+		name:     "clean",
+		input:    `<svg xmlns="http://www.w3.org/2000/svg" width="10"><rect x="1" y="1"/></svg>`,
+		expected: svgRoot + ` width="10"><rect x="1" y="1"></rect></svg>`,
+	},
+	{
+		name:     "script element",
+		input:    `<svg><script type="text/javascript"><![CDATA[alert(1)]]></script><circle r="2"/></svg>`,
+		expected: svgRoot + `><circle r="2"></circle></svg>`,
+	},
+	{
+		name:     "prefixed svg elements",
+		input:    `<svg xmlns:s="http://www.w3.org/2000/svg"><s:script><g>alert(1)</g></s:script><s:g/></svg>`,
+		expected: svgRoot + `><g></g></svg>`,
+	},
+	{
+		name:     "event handlers",
+		input:    `<svg onload="alert(1)"><g OnClick="alert(2)" onclick="alert(3)" id="a"/></svg>`,
+		expected: svgRoot + `><g id="a"></g></svg>`,
+	},
+	{
+		name:     "javascript link",
+		input:    `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><a xlink:href=" java&#x09;script:alert(1)">x</a><a href="/ok">y</a><use xlink:href="#icon"/></svg>`,
+		expected: svgRoot + `><a>x</a><a href="/ok">y</a><use xlink:href="#icon"></use></svg>`,
+	},
+	{
+		name:     "prolog and doctype",
+		input:    `<?xml version="1.0"?><!DOCTYPE svg [<!ENTITY x "y">]><svg><text xml:space="preserve">a &lt; b</text></svg>`,
+		expected: `<?xml version="1.0"?>` + svgRoot + `><text xml:space="preserve">a &lt; b</text></svg>`,
+	},
+	{
+		name:     "stylesheet instruction",
+		input:    `<?xml version="1.0"?><?xml-stylesheet type="text/xsl" href="data:text/xsl,x"?><svg><?php echo 1 ?><g/></svg>`,
+		expected: `<?xml version="1.0"?>` + svgRoot + `><g></g></svg>`,
+	},
+	{
+		name:     "foreign object",
+		input:    `<svg><foreignObject><iframe src="javascript:alert(1)"></iframe></foreignObject><g/></svg>`,
+		expected: svgRoot + `><g></g></svg>`,
+	},
+	{
+		name:     "animations and handler",
+		input:    `<svg><a><set attributeName="href" to="javascript:alert(1)"/><animate attributeName="href" values="javascript:alert(1)"/>x</a><animateMotion/><animateTransform/><handler>alert(1)</handler></svg>`,
+		expected: svgRoot + `><a>x</a></svg>`,
+	},
+	{
+		name:     "data link",
+		input:    `<svg><a href="data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;">x</a><image href=" Data:image/svg+xml,x"/></svg>`,
+		expected: svgRoot + `><a>x</a><image></image></svg>`,
+	},
+	{
+		name:     "unknown attributes",
+		input:    `<svg><g src="javascript:alert(1)" from="a" by="b" to="c" data="d" action="e" formaction="f" id="g"/></svg>`,
+		expected: svgRoot + `><g id="g"></g></svg>`,
+	},
+	{
+		name: "xhtml namespace",
+		input: `<svg xmlns="http://www.w3.org/2000/svg" xmlns:h="http://www.w3.org/1999/xhtml">` +
+			`<h:object data="javascript:alert(1)"></h:object>` +
+			`<h:embed src="data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;"/>` +
+			`<h:form action="javascript:alert(1)"><h:button formaction="javascript:alert(1)">x</h:button></h:form>` +
+			`<h:rect/><circle r="1"/></svg>`,
+		expected: svgRoot + `><circle r="1"></circle></svg>`,
+	},
+	{
+		name:     "default xhtml namespace",
+		input:    `<svg xmlns="http://www.w3.org/2000/svg"><g xmlns="http://www.w3.org/1999/xhtml"><object data="x"></object></g><rect/></svg>`,
+		expected: svgRoot + `><rect></rect></svg>`,
+	},
+	{
+		name:     "unbound prefix",
+		input:    `<svg><x:object data="javascript:alert(1)"/></svg>`,
+		expected: svgRoot + `></svg>`,
+	},
+	{name: "not svg", input: `<html><script>alert(1)</script></html>`, errorExpected: true},
+	{name: "xhtml root", input: `<svg xmlns="http://www.w3.org/1999/xhtml"></svg>`, errorExpected: true},
+	{name: "malformed", input: `<svg><g></svg>`, errorExpected: true},
+	{name: "second root", input: `<svg></svg><html onload="alert(1)"></html>`, errorExpected: true},
+	{name: "empty", input: ``, errorExpected: true},
+}
+
+func TestTools_SanitizeSVG(t *testing.T) {
+	var tools Tools
+
+	for _, test := range sanitizeSVGTests {
+		out, err := tools.SanitizeSVG(strings.NewReader(test.input))
+		if test.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, none received", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if string(out) != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, out)
+		}
+	}
+}
+
+func TestTools_UploadFilesSanitizeSVG(t *testing.T) {
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"><script>alert(2)</script><rect width="1"/></svg>`)
+
+	var tools Tools
+	tools.AllowedFileTypes = []string{"text/plain; charset=utf-8"}
+	tools.SanitizeSVGUploads = true
+
+	dir := t.TempDir()
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "logo.svg", content: svg})
+
+	uploadedFiles, err := tools.UploadFiles(request, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(dir, uploadedFiles[0].NewFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := svgRoot + `><rect width="1"></rect></svg>`
+	if string(stored) != expected {
+		t.Errorf("expected %s, got %s", expected, stored)
+	}
+
+	if uploadedFiles[0].FileSize != int64(len(expected)) {
+		t.Errorf("expected size %d, got %d", len(expected), uploadedFiles[0].FileSize)
+	}
+}
+
+var base64JSONTests = []struct {
+	name          string
+	encoded       string
+	maxSize       int
+	errorExpected bool
+}{
+	{name: "standard padded", encoded: base64.StdEncoding.EncodeToString([]byte(`{"foo": "a>?~~"}`))},
+	{name: "standard raw", encoded: base64.RawStdEncoding.EncodeToString([]byte(`{"foo": "a>?~~"}`))},
+	{name: "url safe padded", encoded: base64.URLEncoding.EncodeToString([]byte(`{"foo": "a>?~~"}`))},
+	{name: "url safe raw", encoded: base64.RawURLEncoding.EncodeToString([]byte(`{"foo": "a>?~~"}`))},
+	{name: "surrounding whitespace", encoded: " " + base64.StdEncoding.EncodeToString([]byte(`{"foo": "a>?~~"}`)) + "\n"},
+	{name: "not base64", encoded: "{not base64}", errorExpected: true},
+	{name: "mixed alphabets", encoded: "ab+c-d", errorExpected: true},
+	{name: "bad JSON", encoded: base64.StdEncoding.EncodeToString([]byte(`{"foo": `)), errorExpected: true},
+	{name: "unknown field", encoded: base64.StdEncoding.EncodeToString([]byte(`{"foo": "a>?~~", "baz": 1}`)), errorExpected: true},
+	{name: "empty", encoded: "", errorExpected: true},
+	{name: "too large", encoded: base64.StdEncoding.EncodeToString([]byte(`{"foo": "a>?~~"}`)), maxSize: 8, errorExpected: true},
+}
+
+func TestTools_DecodeBase64JSON(t *testing.T) {
+	for _, test := range base64JSONTests {
+		var tools Tools
+		tools.MaxJSONSize = test.maxSize
+
+		var payload struct {
+			Foo string `json:"foo"`
+		}
+
+		err := tools.DecodeBase64JSON(test.encoded, &payload)
+		if test.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, none received", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if payload.Foo != "a>?~~" {
+			t.Errorf("%s: expected a>?~~, got %q", test.name, payload.Foo)
+		}
+	}
+
+	var tools Tools
+	tools.MaxJSONSize = 8
+
+	err := tools.DecodeBase64JSON(base64.StdEncoding.EncodeToString([]byte(`{"foo": "a>?~~"}`)), &struct{}{})
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("expected ErrBodyTooLarge, got %v", err)
+	}
+}
+
+var uploadExtensionTests = []struct {
+	name     string
+	allowed  []string
+	filename string
+	fileType string
+	expected string
+}{
+	{name: "no allow list", filename: "shell.php", fileType: "text/plain; charset=utf-8", expected: ".php"},
+	{name: "allowed", allowed: []string{".jpg", ".png"}, filename: "cat.jpg", fileType: "image/jpeg", expected: ".jpg"},
+	{name: "allowed without dot", allowed: []string{"jpg"}, filename: "cat.JPG", fileType: "image/jpeg", expected: ".JPG"},
+	{name: "from sniffed type", allowed: []string{".png"}, filename: "shell.php", fileType: "image/png", expected: ".png"},
+	{name: "missing extension", allowed: []string{".png"}, filename: "image", fileType: "image/png", expected: ".png"},
+	{name: "double extension", allowed: []string{".jpg"}, filename: "cat.jpg.php", fileType: "image/jpeg", expected: ".jpg"},
+	{name: "nothing allowed for type", allowed: []string{".png"}, filename: "shell.php", fileType: "text/html; charset=utf-8", expected: ""},
+}
+
+func TestTools_UploadExtension(t *testing.T) {
+	for _, test := range uploadExtensionTests {
+		var tools Tools
+		tools.AllowedExtensions = test.allowed
+
+		if got := tools.uploadExtension(test.filename, test.fileType); got != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestTools_UploadFilesAllowedExtensions(t *testing.T) {
+	img := readTestImage(t)
+
+	var tools Tools
+	tools.AllowedExtensions = []string{".jpg"}
+
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "cat.php", content: img})
+
+	uploadedFiles, err := tools.UploadFiles(request, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ext := filepath.Ext(uploadedFiles[0].NewFileName); ext != ".jpg" {
+		t.Errorf("expected stored extension .jpg, got %q", ext)
+	}
+}
+
+var jsonCharsetTests = []struct {
+	name          string
+	contentType   string
+	body          []byte
+	expected      string
+	errorExpected bool
+}{
+	{name: "no charset", contentType: "application/json", body: []byte(`{"foo": "café"}`), expected: "café"},
+	{name: "utf-8", contentType: "application/json; charset=UTF-8", body: []byte(`{"foo": "café"}`), expected: "café"},
+	{name: "iso-8859-1", contentType: "application/json; charset=ISO-8859-1", body: []byte("{\"foo\": \"caf\xe9 \xbd\"}"), expected: "café ½"},
+	{name: "latin1 alias", contentType: "application/json; charset=latin1", body: []byte("{\"foo\": \"caf\xe9\"}"), expected: "café"},
+	{name: "windows-1252", contentType: `application/json; charset="windows-1252"`, body: []byte("{\"foo\": \"\x80 caf\xe9\"}"), expected: "€ café"},
+	{name: "utf-16le", contentType: "application/json; charset=utf-16le", body: []byte("{\x00}\x00"), expected: ""},
+	{name: "unknown charset", contentType: "application/json; charset=klingon", body: []byte(`{"foo": "bar"}`), errorExpected: true},
+}
+
+func TestTools_ReadJSONCharset(t *testing.T) {
+	var tools Tools
+
+	for _, test := range jsonCharsetTests {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+
+		var payload struct {
+			Foo string `json:"foo"`
+		}
+
+		err := tools.ReadJSON(httptest.NewRecorder(), req, &payload)
+		if test.errorExpected {
+			if !errors.Is(err, ErrUnsupportedMediaType) {
+				t.Errorf("%s: expected ErrUnsupportedMediaType, got %v", test.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if payload.Foo != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, payload.Foo)
+		}
+	}
+}
+
+func TestTools_NewProgressReader(t *testing.T) {
+	var tools Tools
+
+	data := strings.Repeat("x", 10_000)
+
+	var calls int
+	var lastRead, lastTotal int64
+	r := tools.NewProgressReader(strings.NewReader(data), int64(len(data)), func(read, total int64) {
+		if read < lastRead {
+			t.Errorf("progress went backwards: %d after %d", read, lastRead)
+		}
+		calls++
+		lastRead, lastTotal = read, total
+	})
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != data {
+		t.Error("data changed while reading")
+	}
+
+	if lastRead != int64(len(data)) || lastTotal != int64(len(data)) {
+		t.Errorf("expected final progress %d/%d, got %d/%d", len(data), len(data), lastRead, lastTotal)
+	}
+
+	if calls == 0 {
+		t.Error("progress callback was never called")
+	}
+
+	plain := strings.NewReader(data)
+	if tools.NewProgressReader(plain, 0, nil) != io.Reader(plain) {
+		t.Error("expected the reader to be returned unchanged without a callback")
+	}
+}
+
+func TestTools_UploadFilesProgress(t *testing.T) {
+	img := readTestImage(t)
+
+	var tools Tools
+
+	var names []string
+	var lastRead, lastTotal int64
+	tools.UploadProgress = func(name string, read, total int64) {
+		if len(names) == 0 || names[len(names)-1] != name {
+			names = append(names, name)
+		}
+		lastRead, lastTotal = read, total
+	}
+
+	request := newMultipartRequest(t, testFilePart{field: "file", filename: "cat.jpg", content: img})
+
+	if _, err := tools.UploadFiles(request, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(names, []string{"cat.jpg"}) {
+		t.Errorf("unexpected progress names %v", names)
+	}
+
+	if lastRead != int64(len(img)) || lastTotal != int64(len(img)) {
+		t.Errorf("expected final progress %d/%d, got %d/%d", len(img), len(img), lastRead, lastTotal)
+	}
+}
+
+func TestTools_UploadFilesPartialFailure(t *testing.T) {
+	img := readTestImage(t)
+
+	var tools Tools
+	tools.AllowedFileTypes = []string{"image/jpeg"}
+
+	dir := t.TempDir()
+	request := newMultipartRequest(t,
+		testFilePart{field: "file", filename: "cat.jpg", content: img},
+		testFilePart{field: "file", filename: "notes.txt", content: []byte("plain text")},
+	)
+
+	uploadedFiles, err := tools.UploadFiles(request, dir)
+	if err == nil {
+		t.Fatal("expected error for disallowed file type")
+	}
+
+	if len(uploadedFiles) != 1 || uploadedFiles[0].OriginalFileName != "cat.jpg" {
+		t.Fatalf("expected the stored cat.jpg to be returned, got %v", uploadedFiles)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, uploadedFiles[0].NewFileName)); err != nil {
+		t.Errorf("returned file is not on disk: %s", err)
+	}
+}
+
+func TestTools_JSONReadersCharset(t *testing.T) {
+	var tools Tools
+
+	latin1 := "{\"foo\": \"caf\xe9\"}"
+
+	newRequest := func(body string) *http.Request {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json; charset=ISO-8859-1")
+		req.Header.Set(ReadJSONVersionHeader, "1")
+		return req
+	}
+
+	type payload struct {
+		Foo string `json:"foo"`
+	}
+
+	var withRaw payload
+	raw, err := tools.ReadJSONWithRaw(httptest.NewRecorder(), newRequest(latin1), &withRaw)
+	if err != nil || withRaw.Foo != "café" {
+		t.Errorf("ReadJSONWithRaw: got %q, %v", withRaw.Foo, err)
+	}
+	if string(raw) != latin1 {
+		t.Errorf("ReadJSONWithRaw: expected the raw body as sent, got %q", raw)
+	}
+
+	var jsonc payload
+	if err := tools.ReadJSONC(httptest.NewRecorder(), newRequest(latin1), &jsonc); err != nil || jsonc.Foo != "café" {
+		t.Errorf("ReadJSONC: got %q, %v", jsonc.Foo, err)
+	}
+
+	versioned, _, err := tools.ReadVersionedJSON(httptest.NewRecorder(), newRequest(latin1), map[string]func() any{
+		"1": func() any { return &payload{} },
+	})
+	if err != nil || versioned.(*payload).Foo != "café" {
+		t.Errorf("ReadVersionedJSON: got %v, %v", versioned, err)
+	}
+
+	items, errs := tools.ReadJSONArray(httptest.NewRecorder(), newRequest("["+latin1+"]"), func() any { return &payload{} })
+	if len(errs) != 0 || len(items) != 1 || items[0].(*payload).Foo != "café" {
+		t.Errorf("ReadJSONArray: got %v, %v", items, errs)
+	}
+
+	var forwarded string
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		body, _ := io.ReadAll(req.Body)
+		forwarded = string(body)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{}`)), Header: make(http.Header)}
+	})
+
+	if err := tools.ProxyJSON(httptest.NewRecorder(), newRequest(latin1), "http://upstream.example.com/", client); err != nil {
+		t.Fatal(err)
+	}
+	if forwarded != `{"foo": "café"}` {
+		t.Errorf("ProxyJSON: expected UTF-8 to be forwarded, got %q", forwarded)
+	}
+
+	req := newRequest(latin1)
+	req.Header.Set("Content-Type", "application/json; charset=klingon")
+	if _, err := tools.ReadJSONWithRaw(httptest.NewRecorder(), req, &payload{}); !errors.Is(err, ErrUnsupportedMediaType) {
+		t.Errorf("expected ErrUnsupportedMediaType for an unknown charset, got %v", err)
 	}
 }